@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/vchrisr/cf-postgresql-broker/pgp"
+	"github.com/vchrisr/cf-postgresql-broker/store"
+)
+
+// backend is a PostgreSQL server instances are placed on
+type backend struct {
+	backendConfig
+	pgp *pgp.PGP
+}
+
+// newBackends connects to all provided backends
+func newBackends(configs []backendConfig) ([]*backend, error) {
+	backends := make([]*backend, len(configs))
+	for i, c := range configs {
+		conn, err := pgp.New(c.Source)
+		if err != nil {
+			return nil, fmt.Errorf("backend %q: %v", c.Name, err)
+		}
+		backends[i] = &backend{backendConfig: c, pgp: conn}
+	}
+	return backends, nil
+}
+
+// backend looks up the named backend
+func (sb *serviceBroker) backend(name string) (*backend, error) {
+	for _, b := range sb.backends {
+		if b.Name == name {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown backend %q", name)
+}
+
+// backendOf returns the server the provided instance is placed on
+func (sb *serviceBroker) backendOf(instance *store.Instance) (*pgp.PGP, error) {
+	b, err := sb.backend(instance.Backend)
+	if err != nil {
+		return nil, err
+	}
+	return b.pgp, nil
+}
+
+// backendConfigs returns configurations of all backends
+func (sb *serviceBroker) backendConfigs() []backendConfig {
+	configs := make([]backendConfig, len(sb.backends))
+	for i, b := range sb.backends {
+		configs[i] = b.backendConfig
+	}
+	return configs
+}
+
+// place chooses the backend of a new instance of a plan with the provided
+// settings among the backends the plan is eligible for
+func (sb *serviceBroker) place(ctx context.Context, settings planSettings) (*backend, error) {
+	candidates := make([]*backend, 0, len(sb.backends))
+	for _, b := range sb.backends {
+		if settings.eligible(b.backendConfig) {
+			candidates = append(candidates, b)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return nil, errors.New("no backend is eligible for the plan")
+	case 1:
+		return candidates[0], nil
+	}
+
+	switch settings.Placement {
+	case placeRoundRobin:
+		n := atomic.AddUint64(&sb.turn, 1)
+		return candidates[(n-1)%uint64(len(candidates))], nil
+
+	case placeLeastDisk:
+		// unreachable backends are not going to host new instances anyway
+		var best *backend
+		var least int64
+		for _, b := range candidates {
+			size, err := b.pgp.DiskUsage(ctx)
+			if err != nil {
+				sb.logger.Error("disk-usage", err, lager.Data{"backend": b.Name})
+				continue
+			}
+			if best == nil || size < least {
+				best, least = b, size
+			}
+		}
+		if best == nil {
+			return nil, errors.New("no eligible backend is reachable")
+		}
+		return best, nil
+
+	default:
+		counts, err := sb.store.InstanceCounts(ctx)
+		if err != nil {
+			return nil, err
+		}
+		best := candidates[0]
+		for _, b := range candidates[1:] {
+			if counts[b.Name] < counts[best.Name] {
+				best = b
+			}
+		}
+		return best, nil
+	}
+}
+
+// legacyBackend returns the backend a database of the named instance created
+// before the state store existed lives on, nil when there's none
+func (sb *serviceBroker) legacyBackend(ctx context.Context, instanceID string) *backend {
+	for _, b := range sb.backends {
+		if b.pgp.InstanceExists(ctx, instanceID) {
+			return b
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// ErrNotFound is returned when the requested object doesn't exist
+var ErrNotFound = errors.New("backup not found")
+
+// Store keeps backup objects by key, keys are slash-separated paths
+type Store interface {
+	// Put stores size bytes read from r under the named key, checksum is
+	// the hex encoded SHA-256 of the content, objects not matching it are
+	// rejected
+	Put(ctx context.Context, key string, r io.Reader, size int64, checksum string) error
+
+	// Get opens the object stored under the named key
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// Delete removes the object stored under the named key, missing objects are ignored
+	Delete(ctx context.Context, key string) error
+}
+
+// Checksum returns the hex encoded SHA-256 of the content read from r
+func Checksum(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifier checks size and checksum of the content read through it
+type verifier struct {
+	r        io.Reader
+	h        hash.Hash
+	n        int64
+	size     int64
+	checksum string
+}
+
+// newVerifier wraps r to check that it has the provided size and checksum
+func newVerifier(r io.Reader, size int64, checksum string) *verifier {
+	return &verifier{r: r, h: sha256.New(), size: size, checksum: checksum}
+}
+
+// Read implements io.Reader
+func (v *verifier) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	v.n += int64(n)
+	return n, err
+}
+
+// verify reports content that doesn't match the expected size and checksum
+func (v *verifier) verify() error {
+	if v.n != v.size {
+		return fmt.Errorf("size is %d bytes, want %d", v.n, v.size)
+	}
+	if sum := hex.EncodeToString(v.h.Sum(nil)); sum != v.checksum {
+		return fmt.Errorf("checksum is %s, want %s", sum, v.checksum)
+	}
+	return nil
+}
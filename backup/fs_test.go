@@ -0,0 +1,65 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+)
+
+// testStore checks the round trip of an object through the provided store
+func testStore(t *testing.T, s Store) {
+	ctx := context.Background()
+	content := []byte("PGDMP backup")
+	checksum, err := Checksum(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "instance/2026:10.dump"
+
+	if err := s.Put(ctx, key, bytes.NewReader(content), int64(len(content)), checksum); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(ctx, "instance/corrupt.dump", bytes.NewReader(content), int64(len(content)), emptyChecksum); err == nil {
+		t.Fatal("content not matching the checksum has been stored")
+	}
+	if _, err := s.Get(ctx, "instance/corrupt.dump"); err != ErrNotFound {
+		t.Fatalf("err = %v, want %v", err, ErrNotFound)
+	}
+
+	r, err := s.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("content = %q, want %q", got, content)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.Delete(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Get(ctx, key); err != ErrNotFound {
+		t.Fatalf("err = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestFS(t *testing.T) {
+	s, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+
+	for _, key := range []string{"", "../outside", "instance/../../outside", "/absolute", "instance/.upload-1"} {
+		if err := s.Delete(context.Background(), key); err == nil {
+			t.Errorf("key %q has been accepted", key)
+		}
+	}
+}
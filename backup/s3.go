@@ -0,0 +1,363 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// emptyChecksum is the SHA-256 of requests without a body
+const emptyChecksum = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// defaultPartSize is the size of the parts objects larger than it are uploaded
+// in, single uploads are limited to 5GiB and parts are buffered in memory
+const defaultPartSize = 64 << 20
+
+// requestTimeout bounds every request on the store so that a stalled store
+// cannot hold up backups, uploads send a part at most with a request
+const requestTimeout = 10 * time.Minute
+
+// S3 keeps backups in a bucket of an S3 compatible object store,
+// buckets are addressed path-style as most stand-ins only support that
+type S3 struct {
+	endpoint        *url.URL
+	region          string
+	bucket          string
+	accessKeyID     string
+	secretAccessKey string
+	client          *http.Client
+
+	// partSize is the size of the parts of multipart uploads
+	partSize int64
+
+	// now is the clock requests are signed with
+	now func() time.Time
+}
+
+// NewS3 keeps backups in the named bucket of the store at the named endpoint,
+// AWS is used when endpoint is blank
+func NewS3(endpoint, region, bucket, accessKeyID, secretAccessKey string) (*S3, error) {
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("endpoint %q is not an http or https URL", endpoint)
+	}
+
+	return &S3{
+		endpoint:        u,
+		region:          region,
+		bucket:          bucket,
+		accessKeyID:     accessKeyID,
+		secretAccessKey: secretAccessKey,
+		client:          &http.Client{Timeout: requestTimeout},
+		partSize:        defaultPartSize,
+		now:             time.Now,
+	}, nil
+}
+
+// Put implements Store, the store verifies the checksum it's signed with,
+// objects larger than a part are uploaded in parts
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64, checksum string) error {
+	v := newVerifier(r, size, checksum)
+	if size > s.partSize {
+		return s.putMultipart(ctx, key, v)
+	}
+
+	res, err := s.do(ctx, http.MethodPut, key, nil, ioutil.NopCloser(v), size, checksum)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return responseError(res)
+	}
+	return v.verify()
+}
+
+// Get implements Store
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	res, err := s.do(ctx, http.MethodGet, key, nil, nil, 0, emptyChecksum)
+	if err != nil {
+		return nil, err
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.Body, nil
+	case http.StatusNotFound:
+		res.Body.Close()
+		return nil, ErrNotFound
+	}
+	defer res.Body.Close()
+	return nil, responseError(res)
+}
+
+// Delete implements Store
+func (s *S3) Delete(ctx context.Context, key string) error {
+	res, err := s.do(ctx, http.MethodDelete, key, nil, nil, 0, emptyChecksum)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	return responseError(res)
+}
+
+// completedPart is a part of a multipart upload as it's listed on completion
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// putMultipart uploads the content read through the provided verifier under
+// the named key in parts, the upload is aborted when it cannot be completed
+func (s *S3) putMultipart(ctx context.Context, key string, v *verifier) error {
+	initiated := struct {
+		UploadID string `xml:"UploadId"`
+	}{}
+	if err := s.call(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, &initiated); err != nil {
+		return err
+	}
+
+	if err := s.putParts(ctx, key, initiated.UploadID, v); err != nil {
+		// uploads left behind by crashes are up to the bucket lifecycle
+		s.call(context.Background(), http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil, nil)
+		return err
+	}
+	return nil
+}
+
+// putParts uploads the content read through the provided verifier in parts of
+// the named upload and completes it once the content has been verified
+func (s *S3) putParts(ctx context.Context, key, uploadID string, v *verifier) error {
+	parts := make([]completedPart, 0)
+	buf := make([]byte, s.partSize)
+	for n := 1; ; n++ {
+		read, err := io.ReadFull(v, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		query := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}
+		res, err := s.do(ctx, http.MethodPut, key, query, ioutil.NopCloser(bytes.NewReader(buf[:read])), int64(read), sha256Hex(buf[:read]))
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return responseError(res)
+		}
+		parts = append(parts, completedPart{PartNumber: n, ETag: res.Header.Get("ETag")})
+
+		if read < len(buf) {
+			break
+		}
+	}
+	if err := v.verify(); err != nil {
+		return err
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	return s.call(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body, nil)
+}
+
+// call sends a signed request with the provided body on the named object and
+// decodes the XML response into result unless it's nil, errors may be reported
+// with 200 OK as well
+func (s *S3) call(ctx context.Context, method, key string, query url.Values, body []byte, result interface{}) error {
+	checksum := emptyChecksum
+	var r io.ReadCloser
+	if body != nil {
+		checksum, r = sha256Hex(body), ioutil.NopCloser(bytes.NewReader(body))
+	}
+	res, err := s.do(ctx, method, key, query, r, int64(len(body)), checksum)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		return responseError(res)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(content, []byte("<Error>")) {
+		res.Body = ioutil.NopCloser(bytes.NewReader(content))
+		return responseError(res)
+	}
+	if result == nil {
+		return nil
+	}
+	return xml.Unmarshal(content, result)
+}
+
+// do sends a signed request on the named object
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, body io.ReadCloser, size int64, checksum string) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	u.RawPath = escapePath(u.Path)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Body, req.ContentLength = body, size
+	}
+
+	s.sign(req, checksum, s.now())
+	return s.client.Do(req)
+}
+
+// sign adds AWS signature version 4 headers to the provided request, the host
+// and all headers set so far are signed along with the payload checksum
+func (s *S3) sign(req *http.Request, checksum string, t time.Time) {
+	date := t.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", checksum)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		checksum,
+	}, "\n")
+
+	scope := date[:8] + "/" + s.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", date, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := []byte("AWS4" + s.secretAccessKey)
+	for _, part := range []string{date[:8], s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// escapePath escapes all but unreserved characters of the named path, the
+// way signatures expect it, unlike url.PathEscape it escapes sub-delims too
+func escapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes the provided query sorted by names and values
+// the way signatures expect it
+func canonicalQuery(query url.Values) string {
+	escaped := make(map[string][]string, len(query))
+	names := make([]string, 0, len(query))
+	for name, values := range query {
+		name = escapeQuery(name)
+		names = append(names, name)
+		for _, value := range values {
+			escaped[name] = append(escaped[name], escapeQuery(value))
+		}
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(query))
+	for _, name := range names {
+		values := escaped[name]
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, name+"="+value)
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// escapeQuery escapes all but unreserved characters of the named query component
+func escapeQuery(s string) string {
+	return strings.Replace(escapePath(s), "/", "%2F", -1)
+}
+
+// sha256Hex returns the hex encoded SHA-256 of the named data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hmacSHA256 returns HMAC-SHA256 of the named data with the provided key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// responseError describes the error reported in the provided response
+func responseError(res *http.Response) error {
+	e := struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}{}
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if xml.Unmarshal(body, &e) != nil || e.Code == "" {
+		return fmt.Errorf("object store responded with %s", res.Status)
+	}
+	return fmt.Errorf("object store responded with %s: %s: %s", res.Status, e.Code, e.Message)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/vchrisr/cf-postgresql-broker/backup"
+	"github.com/vchrisr/cf-postgresql-broker/store"
+)
+
+// backupCheckInterval is how often instances are checked for due backups
+const backupCheckInterval = time.Minute
+
+// backupRetryDelay is how long an instance whose backup has failed waits for the next attempt
+const backupRetryDelay = 15 * time.Minute
+
+// backupIDFormat formats backup IDs from their start time, IDs sort chronologically
+const backupIDFormat = "20060102T150405Z"
+
+// newBackupStore opens the object store of the provided configuration
+func newBackupStore(c *backupStoreConfig) (backup.Store, error) {
+	if c.Type == backupStoreS3 {
+		return backup.NewS3(c.Endpoint, c.Region, c.Bucket, c.AccessKeyID, c.SecretAccessKey)
+	}
+	return backup.NewFS(c.Path)
+}
+
+// scheduleBackups takes backups of instances of plans with backups when they're due
+func (sb *serviceBroker) scheduleBackups(ctx context.Context) {
+	ticker := time.NewTicker(backupCheckInterval)
+	defer ticker.Stop()
+
+	// failed backups are retried later rather than on every check
+	failed := make(map[string]time.Time)
+	for {
+		if err := sb.checkBackups(ctx, failed); err != nil {
+			sb.logger.Error("check-backups", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkBackups backs up instances whose last backup is older than the plan interval
+func (sb *serviceBroker) checkBackups(ctx context.Context, failed map[string]time.Time) error {
+	instances, err := sb.store.Instances(ctx)
+	if err != nil {
+		return err
+	}
+
+	c := sb.catalog()
+	for _, instance := range instances {
+		policy := c.planSettings(instance.PlanID).Backups
+		if policy == nil || instance.SharedDatabase != "" || time.Since(failed[instance.ID]) < backupRetryDelay {
+			continue
+		}
+
+		if err := sb.checkBackup(ctx, instance, policy); err != nil {
+			sb.logger.Error("backup", err, lager.Data{"instance": instance.ID})
+			failed[instance.ID] = time.Now()
+			continue
+		}
+		delete(failed, instance.ID)
+	}
+	return sb.expireDeprovisioned(ctx)
+}
+
+// checkBackup backs up the provided instance when a backup is due
+// and expires backups the policy doesn't keep anymore
+func (sb *serviceBroker) checkBackup(ctx context.Context, instance *store.Instance, policy *backupPolicy) error {
+	due, err := sb.backupDue(ctx, instance.ID, policy)
+	if err != nil || !due {
+		return err
+	}
+
+	// databases of instances being provisioned or deprovisioned come and go
+	op, err := sb.inProgress(ctx, instance.ID, "")
+	if err != nil {
+		return err
+	}
+	if op != nil && (op.Kind == opProvision || op.Kind == opDeprovision) {
+		return nil
+	}
+
+	// other broker instances check the same instances
+	release, ok, err := sb.store.TryLock(ctx, "backup:"+instance.ID)
+	if err != nil || !ok {
+		return err
+	}
+	defer release()
+
+	if due, err := sb.backupDue(ctx, instance.ID, policy); err != nil || !due {
+		return err
+	}
+	if err := sb.backup(ctx, instance); err != nil {
+		return err
+	}
+	return sb.expireBackups(ctx, instance.ID, policy)
+}
+
+// backupDue checks whether the last backup of the named instance is older than the policy interval
+func (sb *serviceBroker) backupDue(ctx context.Context, instanceID string, policy *backupPolicy) (bool, error) {
+	backups, err := sb.store.Backups(ctx, instanceID)
+	if err != nil {
+		return false, err
+	}
+	return len(backups) == 0 || time.Since(backups[0].CreatedAt) >= policy.interval(), nil
+}
+
+// backup dumps the database of the provided instance into the backup store and
+// records it in the backup catalog, the dump is spooled to a temporary file to
+// learn its size and checksum before the upload
+func (sb *serviceBroker) backup(ctx context.Context, instance *store.Instance) error {
+	conn, err := sb.backendOf(instance)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile("", "backup-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	started := time.Now().UTC()
+	if err := conn.Dump(ctx, instance.ID, f); err != nil {
+		return err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	checksum, err := backup.Checksum(f)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	b := &store.Backup{
+		ID:         started.Format(backupIDFormat),
+		InstanceID: instance.ID,
+		Size:       size,
+		Checksum:   checksum,
+	}
+	b.Key = instance.ID + "/" + b.ID + ".dump"
+	if err := sb.backupStore.Put(ctx, b.Key, f, size, checksum); err != nil {
+		return err
+	}
+
+	// the instance may have been deprovisioned meanwhile
+	if err := sb.store.CreateBackup(ctx, b); err != nil {
+		if err != store.ErrExists {
+			sb.backupStore.Delete(ctx, b.Key)
+		}
+		return err
+	}
+	sb.logger.Info("backup", lager.Data{"instance": instance.ID, "key": b.Key, "size": size, "duration": time.Since(started).String()})
+	return nil
+}
+
+// expireBackups removes backups of the named instance the provided policy doesn't keep
+func (sb *serviceBroker) expireBackups(ctx context.Context, instanceID string, policy *backupPolicy) error {
+	backups, err := sb.store.Backups(ctx, instanceID)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range expired(backups, policy, time.Now()) {
+		if err := sb.deleteBackup(ctx, b); err != nil {
+			return err
+		}
+		sb.logger.Info("expire-backup", lager.Data{"instance": instanceID, "key": b.Key})
+	}
+	return nil
+}
+
+// expireDeprovisioned removes backups of deprovisioned instances the policy
+// of their plan doesn't retain anymore, one broker instance at a time
+func (sb *serviceBroker) expireDeprovisioned(ctx context.Context) error {
+	release, ok, err := sb.store.TryLock(ctx, "backup-expiry")
+	if err != nil || !ok {
+		return err
+	}
+	defer release()
+
+	backups, err := sb.store.DeprovisionedBackups(ctx)
+	if err != nil {
+		return err
+	}
+	for _, b := range expiredDeprovisioned(backups, sb.catalog(), time.Now()) {
+		if err := sb.deleteBackup(ctx, b); err != nil {
+			return err
+		}
+		sb.logger.Info("expire-backup", lager.Data{"instance": b.InstanceID, "key": b.Key})
+	}
+	return nil
+}
+
+// deleteBackup removes the provided backup from the store and the catalog
+func (sb *serviceBroker) deleteBackup(ctx context.Context, b *store.Backup) error {
+	if err := sb.backupStore.Delete(ctx, b.Key); err != nil {
+		return err
+	}
+	if err := sb.store.DeleteBackup(ctx, b.InstanceID, b.ID); err != nil && err != store.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// expired returns the provided backups, newest first, that are beyond the
+// number the policy keeps or older than its maximum age at the provided time,
+// the newest backup never expires
+func expired(backups []*store.Backup, policy *backupPolicy, now time.Time) []*store.Backup {
+	old := make([]*store.Backup, 0)
+	maxAge := policy.maxAge()
+	for i, b := range backups {
+		switch {
+		case i == 0:
+		case policy.Keep != 0 && i >= policy.Keep, maxAge != 0 && now.Sub(b.CreatedAt) > maxAge:
+			old = append(old, b)
+		}
+	}
+	return old
+}
+
+// expiredDeprovisioned returns the provided backups of deprovisioned instances
+// that have been retained as long as the policy of their plan asks for
+func expiredDeprovisioned(backups []*store.Backup, c *catalog, now time.Time) []*store.Backup {
+	old := make([]*store.Backup, 0)
+	for _, b := range backups {
+		if now.Sub(b.DeprovisionedAt) > c.planSettings(b.PlanID).Backups.retainDeprovisioned() {
+			old = append(old, b)
+		}
+	}
+	return old
+}
+
+// backupsCatalog describes the provided backups in instance details
+func backupsCatalog(backups []*store.Backup) []map[string]interface{} {
+	described := make([]map[string]interface{}, len(backups))
+	for i, b := range backups {
+		described[i] = map[string]interface{}{
+			"id":         b.ID,
+			"created_at": b.CreatedAt.UTC().Format(time.RFC3339),
+			"size_bytes": b.Size,
+			"sha256":     b.Checksum,
+		}
+	}
+	return described
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vchrisr/cf-postgresql-broker/store"
+)
+
+func TestExpired(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	backups := make([]*store.Backup, 5)
+	for i := range backups {
+		backups[i] = &store.Backup{ID: string(rune('a' + i)), CreatedAt: now.Add(-time.Duration(i) * 24 * time.Hour)}
+	}
+
+	for _, tc := range []struct {
+		policy backupPolicy
+		want   string
+	}{
+		{backupPolicy{Interval: "24h"}, ""},
+		{backupPolicy{Interval: "24h", Keep: 3}, "de"},
+		{backupPolicy{Interval: "24h", MaxAge: "48h"}, "de"},
+		{backupPolicy{Interval: "24h", Keep: 2, MaxAge: "72h"}, "cde"},
+		{backupPolicy{Interval: "24h", Keep: 1}, "bcde"},
+		{backupPolicy{Interval: "24h", MaxAge: "1h"}, "bcde"},
+	} {
+		got := ""
+		for _, b := range expired(backups, &tc.policy, now) {
+			got += b.ID
+		}
+		if got != tc.want {
+			t.Errorf("%+v: expired = %q, want %q", tc.policy, got, tc.want)
+		}
+	}
+
+	// the only backup is kept however old it is
+	if old := expired(backups[4:], &backupPolicy{Interval: "24h", MaxAge: "1h"}, now); len(old) != 0 {
+		t.Fatalf("expired = %v", old)
+	}
+}
+
+func TestExpiredDeprovisioned(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	c := &catalog{settings: map[string]planSettings{
+		"daily": {Backups: &backupPolicy{Interval: "24h", RetainDeprovisioned: "720h"}},
+		"plain": {Backups: &backupPolicy{Interval: "24h"}},
+	}}
+	backups := []*store.Backup{
+		{ID: "a", PlanID: "daily", DeprovisionedAt: now.Add(-10 * 24 * time.Hour)},
+		{ID: "b", PlanID: "daily", DeprovisionedAt: now.Add(-31 * 24 * time.Hour)},
+		{ID: "c", PlanID: "plain", DeprovisionedAt: now.Add(-6 * 24 * time.Hour)},
+		{ID: "d", PlanID: "plain", DeprovisionedAt: now.Add(-8 * 24 * time.Hour)},
+		{ID: "e", PlanID: "gone", DeprovisionedAt: now.Add(-8 * 24 * time.Hour)},
+	}
+
+	got := ""
+	for _, b := range expiredDeprovisioned(backups, c, now) {
+		got += b.ID
+	}
+	if got != "bde" {
+		t.Fatalf("expired = %q, want %q", got, "bde")
+	}
+}
+
+func TestBackupsCatalog(t *testing.T) {
+	created := time.Date(2026, 10, 16, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	got := backupsCatalog([]*store.Backup{{ID: "20261016T100000Z", Size: 1024, Checksum: "abc", CreatedAt: created}})
+	want := []map[string]interface{}{{
+		"id":         "20261016T100000Z",
+		"created_at": "2026-10-16T10:00:00Z",
+		"size_bytes": int64(1024),
+		"sha256":     "abc",
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("catalog = %v, want %v", got, want)
+	}
+}
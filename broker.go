@@ -3,80 +3,554 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"net/http"
+	"os/exec"
+	"reflect"
 	"strings"
+	"sync"
 
+	"code.cloudfoundry.org/lager"
 	"github.com/pivotal-cf/brokerapi"
+	"github.com/vchrisr/cf-postgresql-broker/backup"
 	"github.com/vchrisr/cf-postgresql-broker/pgp"
+	"github.com/vchrisr/cf-postgresql-broker/store"
 )
 
 // NewServiceBroker creates a new brokerapi.ServiceBroker entity
-func NewServiceBroker(source, servicesJSON, GUID string) (brokerapi.ServiceBroker, error) {
-	conn, err := pgp.New(source)
+func NewServiceBroker(cfg *config, logger lager.Logger) (*serviceBroker, error) {
+	backends, err := newBackends(cfg.backends())
 	if err != nil {
 		return nil, err
 	}
 
-	// parse services list
-	services := make([]brokerapi.Service, 0)
-	if err := json.Unmarshal([]byte(servicesJSON), &services); err != nil {
+	state, err := store.New(cfg.Source, cfg.CredentialsSecret)
+	if err != nil {
 		return nil, err
 	}
 
-	// replace func
-	replace := func(str string) string {
-		return strings.Replace(str, "{GUID}", GUID, 1)
+	sb := &serviceBroker{backends: backends, store: state, logger: logger}
+	if cfg.BackupStore != nil {
+		if sb.backupStore, err = newBackupStore(cfg.BackupStore); err != nil {
+			return nil, err
+		}
+	}
+	if err := sb.reload(cfg); err != nil {
+		return nil, err
 	}
 
-	// replace GUID with its actual value
-	for i := 0; i < len(services); i++ {
-		services[i].ID = replace(services[i].ID)
-		for j := 0; j < len(services[i].Plans); j++ {
-			services[i].Plans[j].ID = replace(services[i].Plans[j].ID)
-		}
+	if err := sb.reconcile(context.Background()); err != nil {
+		return nil, err
 	}
 
-	return &serviceBroker{pgp: conn, services: services}, nil
+	go sb.monitor(context.Background())
+	if sb.backupStore != nil {
+		go sb.scheduleBackups(context.Background())
+	}
+	return sb, nil
 }
 
 // serviceBroker implements brokerapi.ServiceBroker
 type serviceBroker struct {
-	pgp      *pgp.PGP
-	services []brokerapi.Service
+	// turn is the round-robin placement counter, it's accessed atomically
+	turn uint64
+
+	backends []*backend
+	store    *store.Store
+	logger   lager.Logger
+
+	// backupStore keeps backups of instances, nil when none is configured
+	backupStore backup.Store
+
+	mu  sync.RWMutex
+	cat *catalog
+}
+
+// reload replaces the catalog with the one of the provided configuration,
+// requests in flight keep using the catalog they've started with
+func (sb *serviceBroker) reload(cfg *config) error {
+	c, err := newCatalog(cfg.Services, cfg.GUID)
+	if err != nil {
+		return err
+	}
+
+	// backends and the backup store are only read on boot
+	_, dump := exec.LookPath(pgp.DumpCommand)
+	errs := append(c.validatePlacement(sb.backendConfigs()), c.validateSeeds(cfg.seeds)...)
+	errs = append(errs, c.validateBackups(sb.backupStore != nil, dump)...)
+	if len(errs) != 0 {
+		return validationError(errs)
+	}
+	c.seeds = cfg.seeds
+	c.masking = cfg.masking
+
+	sb.mu.Lock()
+	sb.cat = c
+	sb.mu.Unlock()
+	return nil
+}
+
+// catalog returns the current catalog
+func (sb *serviceBroker) catalog() *catalog {
+	sb.mu.RLock()
+	defer sb.mu.RUnlock()
+	return sb.cat
 }
 
 // Services implements brokerapi.ServiceBroker
 func (sb *serviceBroker) Services(ctx context.Context) ([]brokerapi.Service, error) {
-	return sb.services, nil
+	return sb.catalog().services, nil
 }
 
 // Provision implements brokerapi.ServiceBroker
-func (sb *serviceBroker) Provision(ctx context.Context, instanceID string, _ brokerapi.ProvisionDetails, _ bool) (brokerapi.ProvisionedServiceSpec, error) {
-	dbname, err := sb.pgp.CreateDB(ctx, instanceID)
+func (sb *serviceBroker) Provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, error) {
+	settings := sb.catalog().planSettings(details.PlanID)
+	if err := validateParams(planSchemas(settings).Instance.Create, details.RawParameters); err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+
+	instance := &store.Instance{
+		ID:               instanceID,
+		ServiceID:        details.ServiceID,
+		PlanID:           details.PlanID,
+		OrganizationGUID: details.OrganizationGUID,
+		SpaceGUID:        details.SpaceGUID,
+		Parameters:       details.RawParameters,
+		Context:          details.RawContext,
+		SharedDatabase:   settings.sharedDatabase(),
+	}
+
+	existing, err := sb.store.Instance(ctx, instanceID)
+	switch {
+	case err == nil && sameInstance(existing, instance):
+		conn, err := sb.backendOf(existing)
+		if err != nil {
+			return brokerapi.ProvisionedServiceSpec{}, err
+		}
+
+		// an identical request of a provisioning in progress gets the same operation
+		op, err := sb.inProgress(ctx, instanceID, "")
+		if err != nil {
+			return brokerapi.ProvisionedServiceSpec{}, err
+		}
+		if op != nil && op.Kind == opProvision {
+			return brokerapi.ProvisionedServiceSpec{IsAsync: true, DashboardURL: conn.DBName(instanceID), OperationData: op.ID}, nil
+		}
+		return brokerapi.ProvisionedServiceSpec{AlreadyExists: true, DashboardURL: conn.DBName(instanceID)}, nil
+	case err == nil:
+		return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrInstanceAlreadyExists
+	case err != store.ErrNotFound:
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+
+	// databases provisioned before the state store existed are unknown to it
+	if sb.legacyBackend(ctx, instanceID) != nil {
+		return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrInstanceAlreadyExists
+	}
+
+	params, err := decodeInstanceParams(details.RawParameters)
 	if err != nil {
 		return brokerapi.ProvisionedServiceSpec{}, err
 	}
 
+	errs := validateMaskRules(params.Masking, "parameters.masking")
+	if len(params.Masking) != 0 && params.CloneFrom == "" {
+		errs = append(errs, "parameters.masking: requires clone_from")
+	}
+	if len(errs) != 0 {
+		return brokerapi.ProvisionedServiceSpec{}, brokerapi.NewFailureResponse(
+			fmt.Errorf("invalid parameters: %s", strings.Join(errs, "; ")), http.StatusBadRequest, "invalid-parameters")
+	}
+
+	// copies are placed on the backend of their source
+	var target *backend
+	if params.CloneFrom != "" {
+		if !asyncAllowed {
+			return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrAsyncRequired
+		}
+		target, err = sb.cloneSource(ctx, details, settings, params)
+	} else {
+		target, err = sb.place(ctx, settings)
+	}
+	if err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+	instance.Backend = target.Name
+
+	// database options are checked before anything is created
+	if instance.SharedDatabase == "" && params.CloneFrom == "" {
+		err = target.pgp.ValidateDBOptions(ctx, settings.dbOptions(params))
+		if _, ok := err.(pgp.UnsupportedError); ok {
+			return brokerapi.ProvisionedServiceSpec{}, brokerapi.NewFailureResponse(err, http.StatusBadRequest, "unsupported-option")
+		}
+		if err != nil {
+			return brokerapi.ProvisionedServiceSpec{}, err
+		}
+	}
+
+	if err := sb.store.CreateInstance(ctx, instance); err != nil {
+		if err == store.ErrExists {
+			return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrInstanceAlreadyExists
+		}
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+
+	if asyncAllowed {
+		id, err := sb.start(ctx, opProvision, instanceID, "", nil)
+		return brokerapi.ProvisionedServiceSpec{IsAsync: true, DashboardURL: target.pgp.DBName(instanceID), OperationData: id}, err
+	}
+
+	if err := sb.perform(ctx, opProvision, instanceID, "", nil); err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, apiError(err)
+	}
+
 	return brokerapi.ProvisionedServiceSpec{
 		IsAsync:      false,
-		DashboardURL: dbname,
+		DashboardURL: target.pgp.DBName(instanceID),
 	}, nil
 }
 
+// cloneSource checks that the source instance named by the provided parameters
+// can be copied into a new instance of the provision request and returns
+// the backend it's placed on
+func (sb *serviceBroker) cloneSource(ctx context.Context, details brokerapi.ProvisionDetails, settings planSettings, params *instanceParams) (*backend, error) {
+	invalid := func(format string, args ...interface{}) error {
+		return brokerapi.NewFailureResponse(fmt.Errorf(format, args...), http.StatusBadRequest, "invalid-clone-source")
+	}
+
+	// copies keep encoding, locale and data of their source
+	if params.Encoding != "" || params.LCCollate != "" || params.LCCtype != "" || params.ICULocale != "" || params.Template != "" || params.Seed != "" {
+		return nil, invalid("clone_from cannot be combined with encoding, locale, template and seed parameters")
+	}
+
+	// instances of other spaces are indistinguishable from missing ones
+	source, err := sb.store.Instance(ctx, params.CloneFrom)
+	if err == store.ErrNotFound || err == nil && (source.OrganizationGUID != details.OrganizationGUID || source.SpaceGUID != details.SpaceGUID) {
+		return nil, invalid("instance %q cannot be cloned into the space", params.CloneFrom)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if source.SharedDatabase != "" {
+		return nil, invalid("instances sharing a database cannot be cloned")
+	}
+
+	if op, err := sb.inProgress(ctx, source.ID, ""); err != nil {
+		return nil, err
+	} else if op != nil {
+		return nil, brokerapi.ErrConcurrentInstanceAccess
+	}
+
+	b, err := sb.backend(source.Backend)
+	if err != nil {
+		return nil, err
+	}
+	if !settings.eligible(b.backendConfig) {
+		return nil, invalid("the plan cannot be placed on the backend of instance %q", source.ID)
+	}
+	return b, nil
+}
+
+// runProvision creates the database, or the schema in the shared
+// database, of the instance of the provided operation
+func (sb *serviceBroker) runProvision(ctx context.Context, op *store.Operation) error {
+	instance, err := sb.store.Instance(ctx, op.InstanceID)
+	if err != nil {
+		return err
+	}
+	conn, err := sb.backendOf(instance)
+	if err != nil {
+		return err
+	}
+
+	// the instance record reserves the database and schema names, an
+	// existing one has been created by an interrupted attempt
+	if instance.SharedDatabase != "" {
+		if _, err := conn.CreateSchema(ctx, instance.SharedDatabase, op.InstanceID); err != nil && err != pgp.ErrSchemaExists {
+			return err
+		}
+		return nil
+	}
+
+	params, err := decodeInstanceParams(instance.Parameters)
+	if err != nil {
+		return err
+	}
+
+	settings := sb.catalog().planSettings(instance.PlanID)
+	if params.CloneFrom != "" {
+		sb.progress(ctx, op, fmt.Sprintf("copying the database of instance %s", params.CloneFrom))
+		if _, err := conn.CloneDB(ctx, op.InstanceID, params.CloneFrom); err != nil {
+			return err
+		}
+
+		// a copy failing to be scrubbed is dropped along with the data
+		rules := append(maskRules(sb.catalog().masking, true), maskRules(params.Masking, false)...)
+		if len(rules) != 0 {
+			sb.progress(ctx, op, "masking the copy")
+			if err := conn.MaskDB(ctx, op.InstanceID, rules); err != nil {
+				return err
+			}
+		}
+		sb.progress(ctx, op, "configuring the copy")
+	} else if _, err := conn.CreateDB(ctx, op.InstanceID, settings.dbOptions(params)); err != nil && err != pgp.ErrDatabaseExists {
+		return err
+	}
+	if err := conn.AlterDB(ctx, op.InstanceID, settings.dbSettings()); err != nil {
+		return err
+	}
+	if err := conn.ConfigureDB(ctx, op.InstanceID, params.settings(), nil); err != nil {
+		return err
+	}
+	if err := conn.CreateExtensions(ctx, op.InstanceID, params.Extensions); err != nil {
+		return err
+	}
+
+	// a failing seed fails the provisioning dropping the database,
+	// copies have the data of their source instead
+	name := settings.seed(params)
+	if name == "" || params.CloneFrom != "" {
+		return nil
+	}
+	seed, ok := sb.catalog().seeds[name]
+	if !ok {
+		return fmt.Errorf("unknown seed %q", name)
+	}
+	return conn.Seed(ctx, op.InstanceID, seed)
+}
+
+// abortProvision drops the database of a failed provisioning and forgets the instance
+func (sb *serviceBroker) abortProvision(ctx context.Context, op *store.Operation) {
+	instance, err := sb.store.Instance(ctx, op.InstanceID)
+	if err != nil {
+		sb.logger.Error("abort-provision", err, lager.Data{"instance": op.InstanceID})
+		return
+	}
+
+	if err := sb.dropInstance(ctx, instance); err != nil {
+		sb.logger.Error("drop-instance", err, lager.Data{"instance": op.InstanceID})
+	}
+	if err := sb.store.DeleteInstance(ctx, op.InstanceID); err != nil && err != store.ErrNotFound {
+		sb.logger.Error("delete-instance", err, lager.Data{"instance": op.InstanceID})
+	}
+}
+
+// GetInstance implements brokerapi.ServiceBroker
 func (sb *serviceBroker) GetInstance(ctx context.Context, instanceID string) (brokerapi.GetInstanceDetailsSpec, error) {
-	return brokerapi.GetInstanceDetailsSpec{}, fmt.Errorf("Function not implemented")
+	instance, err := sb.store.Instance(ctx, instanceID)
+	if err == store.ErrNotFound {
+		return brokerapi.GetInstanceDetailsSpec{}, errInstanceNotFound
+	}
+	if err != nil {
+		return brokerapi.GetInstanceDetailsSpec{}, err
+	}
+
+	// instances being provisioned are not retrievable yet and
+	// instances being updated cannot be retrieved consistently
+	op, err := sb.store.LatestOperation(ctx, instanceID, "")
+	if err != nil && err != store.ErrNotFound {
+		return brokerapi.GetInstanceDetailsSpec{}, err
+	}
+	if op != nil && op.State == string(brokerapi.InProgress) {
+		switch op.Kind {
+		case opProvision:
+			return brokerapi.GetInstanceDetailsSpec{}, errInstanceNotFound
+		case opUpdate:
+			return brokerapi.GetInstanceDetailsSpec{}, brokerapi.ErrConcurrentInstanceAccess
+		}
+	}
+
+	conn, err := sb.backendOf(instance)
+	if err != nil {
+		return brokerapi.GetInstanceDetailsSpec{}, err
+	}
+
+	// the API has no other place for the state of the instance than parameters,
+	// it's kept under a key parameters cannot have
+	var params map[string]interface{}
+	if len(instance.Parameters) != 0 {
+		if err := json.Unmarshal(instance.Parameters, &params); err != nil {
+			return brokerapi.GetInstanceDetailsSpec{}, err
+		}
+	}
+	if params == nil {
+		params = make(map[string]interface{})
+	}
+	params[statusParam] = sb.instanceStatus(ctx, instance, conn)
+
+	return brokerapi.GetInstanceDetailsSpec{
+		ServiceID:    instance.ServiceID,
+		PlanID:       instance.PlanID,
+		DashboardURL: conn.DBName(instanceID),
+		Parameters:   params,
+	}, nil
+}
+
+// instanceStatus describes the state of the provided instance: its usage, the
+// settings in effect including the plan ones, installed extensions and backups,
+// those that cannot be read are left out rather than failing instance details
+func (sb *serviceBroker) instanceStatus(ctx context.Context, instance *store.Instance, conn *pgp.PGP) map[string]interface{} {
+	status := map[string]interface{}{"usage": usage(sb.catalog(), instance)}
+	if instance.SharedDatabase != "" {
+		return status
+	}
+
+	if settings, err := conn.Settings(ctx, instance.ID); err != nil {
+		sb.logger.Error("instance-settings", err, lager.Data{"instance": instance.ID})
+	} else {
+		status["effective_settings"] = settings
+	}
+
+	if extensions, err := conn.Extensions(ctx, instance.ID); err != nil {
+		sb.logger.Error("instance-extensions", err, lager.Data{"instance": instance.ID})
+	} else {
+		versions := make(map[string]string, len(extensions))
+		for _, e := range extensions {
+			versions[e.Name] = e.Version
+		}
+		status["installed_extensions"] = versions
+	}
+
+	if backups, err := sb.store.Backups(ctx, instance.ID); err != nil {
+		sb.logger.Error("instance-backups", err, lager.Data{"instance": instance.ID})
+	} else {
+		status["backups"] = backupsCatalog(backups)
+	}
+	return status
 }
 
 // Deprovision implements brokerapi.ServiceBroker
-func (sb *serviceBroker) Deprovision(ctx context.Context, instanceID string, _ brokerapi.DeprovisionDetails, _ bool) (brokerapi.DeprovisionServiceSpec, error) {
-	go sb.pgp.DropDB(ctx, instanceID)
-	return brokerapi.DeprovisionServiceSpec{IsAsync: true, OperationData: "DROP DB in progress"}, nil
+func (sb *serviceBroker) Deprovision(ctx context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (brokerapi.DeprovisionServiceSpec, error) {
+	if _, err := sb.instance(ctx, instanceID, details.ServiceID, details.PlanID); err != nil {
+		return brokerapi.DeprovisionServiceSpec{}, err
+	}
+
+	op, err := sb.inProgress(ctx, instanceID, "")
+	if err != nil {
+		return brokerapi.DeprovisionServiceSpec{}, err
+	}
+	if op != nil && op.Kind == opDeprovision {
+		return brokerapi.DeprovisionServiceSpec{IsAsync: true, OperationData: op.ID}, nil
+	}
+	if op != nil {
+		return brokerapi.DeprovisionServiceSpec{}, brokerapi.ErrConcurrentInstanceAccess
+	}
+	if busy, err := sb.bindingsInProgress(ctx, instanceID); err != nil {
+		return brokerapi.DeprovisionServiceSpec{}, err
+	} else if busy {
+		return brokerapi.DeprovisionServiceSpec{}, brokerapi.ErrConcurrentInstanceAccess
+	}
+
+	if !asyncAllowed {
+		return brokerapi.DeprovisionServiceSpec{}, apiError(sb.perform(ctx, opDeprovision, instanceID, "", nil))
+	}
+
+	id, err := sb.start(ctx, opDeprovision, instanceID, "", nil)
+	return brokerapi.DeprovisionServiceSpec{IsAsync: true, OperationData: id}, err
+}
+
+// runDeprovision drops the database of the instance of the provided operation
+func (sb *serviceBroker) runDeprovision(ctx context.Context, op *store.Operation) error {
+	// an interrupted attempt may have forgotten the instance already
+	instance, err := sb.store.Instance(ctx, op.InstanceID)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := sb.dropInstance(ctx, instance); err != nil {
+		return err
+	}
+	// backups are kept for a while in case the instance was deprovisioned by mistake
+	if err := sb.store.RetainBackups(ctx, op.InstanceID); err != nil {
+		return err
+	}
+	if err := sb.store.DeleteInstance(ctx, op.InstanceID); err != nil && err != store.ErrNotFound {
+		return err
+	}
+	return nil
 }
 
 // Bind implements brokerapi.ServiceBroker
-func (sb *serviceBroker) Bind(ctx context.Context, instanceID, bindingID string, _ brokerapi.BindDetails, asyncAllowed bool) (brokerapi.Binding, error) {
-	creds, err := sb.pgp.CreateUser(ctx, instanceID, bindingID)
+func (sb *serviceBroker) Bind(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails, asyncAllowed bool) (brokerapi.Binding, error) {
+	instance, err := sb.instance(ctx, instanceID, details.ServiceID, details.PlanID)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+
+	settings := sb.catalog().planSettings(instance.PlanID)
+	if err := validateParams(planSchemas(settings).Binding.Create, details.RawParameters); err != nil {
+		return brokerapi.Binding{}, err
+	}
+
+	// the instance is being provisioned, updated or deprovisioned
+	if op, err := sb.inProgress(ctx, instanceID, ""); err != nil {
+		return brokerapi.Binding{}, err
+	} else if op != nil {
+		return brokerapi.Binding{}, brokerapi.ErrConcurrentInstanceAccess
+	}
+
+	// an identical request gets the credentials issued the first time
+	existing, err := sb.store.Binding(ctx, instanceID, bindingID)
+	switch {
+	case err == nil && len(existing.Credentials) != 0 && sameBinding(existing, details):
+		creds, err := credentials(existing)
+		if err != nil {
+			return brokerapi.Binding{}, err
+		}
+		return brokerapi.Binding{AlreadyExists: true, Credentials: creds}, nil
+	case err == nil:
+		return brokerapi.Binding{}, brokerapi.ErrBindingAlreadyExists
+	case err != store.ErrNotFound:
+		return brokerapi.Binding{}, err
+	}
+
+	// the binding is still being created by a previous request
+	op, err := sb.inProgress(ctx, instanceID, bindingID)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+	if op != nil && op.Kind == opBind {
+		return brokerapi.Binding{IsAsync: true, OperationData: op.ID}, nil
+	}
+	if op != nil {
+		return brokerapi.Binding{}, brokerapi.ErrConcurrentInstanceAccess
+	}
+
+	// bindings created before the state store existed are unknown to it
+	conn, err := sb.backendOf(instance)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+	if conn.UserExists(ctx, bindingID) {
+		return brokerapi.Binding{}, brokerapi.ErrBindingAlreadyExists
+	}
+
+	payload := &bindPayload{
+		ServiceID:  details.ServiceID,
+		PlanID:     details.PlanID,
+		AppGUID:    details.AppGUID,
+		Parameters: details.RawParameters,
+		Context:    details.RawContext,
+	}
+
+	// CreateUser may block on locks of a busy database for a long time
+	if asyncAllowed {
+		id, err := sb.start(ctx, opBind, instanceID, bindingID, payload)
+		return brokerapi.Binding{IsAsync: true, OperationData: id}, err
+	}
+
+	if err := sb.perform(ctx, opBind, instanceID, bindingID, payload); err != nil {
+		return brokerapi.Binding{}, apiError(err)
+	}
+
+	binding, err := sb.store.Binding(ctx, instanceID, bindingID)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+	creds, err := credentials(binding)
 	if err != nil {
 		return brokerapi.Binding{}, err
 	}
@@ -86,31 +560,533 @@ func (sb *serviceBroker) Bind(ctx context.Context, instanceID, bindingID string,
 	}, nil
 }
 
+// bindPayload are the bind request details a bind operation is performed with
+type bindPayload struct {
+	ServiceID  string          `json:"service_id"`
+	PlanID     string          `json:"plan_id"`
+	AppGUID    string          `json:"app_guid"`
+	Parameters json.RawMessage `json:"parameters,omitempty"`
+	Context    json.RawMessage `json:"context,omitempty"`
+}
+
+// runBind creates the user of the binding of the provided operation
+// and stores the binding along with its credentials
+func (sb *serviceBroker) runBind(ctx context.Context, op *store.Operation) error {
+	payload := &bindPayload{}
+	if err := json.Unmarshal(op.Payload, payload); err != nil {
+		return err
+	}
+
+	// an interrupted attempt may have stored the binding already
+	if _, err := sb.store.Binding(ctx, op.InstanceID, op.BindingID); err != store.ErrNotFound {
+		return err
+	}
+
+	instance, err := sb.store.Instance(ctx, op.InstanceID)
+	if err != nil {
+		return err
+	}
+
+	params, err := decodeBindParams(payload.Parameters)
+	if err != nil {
+		return err
+	}
+
+	conn, err := sb.backendOf(instance)
+	if err != nil {
+		return err
+	}
+
+	settings := sb.catalog().planSettings(instance.PlanID)
+	var creds *pgp.Credentials
+	if instance.SharedDatabase != "" {
+		creds, err = conn.CreateSchemaUser(ctx, instance.SharedDatabase, op.InstanceID, op.BindingID, params.Role)
+	} else {
+		creds, err = conn.CreateUser(ctx, op.InstanceID, op.BindingID, params.Role, settings.privileges())
+	}
+	if err != nil {
+		return err
+	}
+	if err := limitUser(ctx, conn, settings, op.BindingID, params, creds); err != nil {
+		return err
+	}
+
+	// restrictions of instances over quota apply to every user separately
+	if instance.QuotaExceeded {
+		if instance.SharedDatabase != "" {
+			err = conn.RestrictSchema(ctx, instance.SharedDatabase, op.InstanceID, true)
+		} else {
+			err = conn.RestrictDB(ctx, op.InstanceID, true)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// credentials are kept to be fetched again by GetBinding
+	raw, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+
+	return sb.store.CreateBinding(ctx, &store.Binding{
+		ID:          op.BindingID,
+		InstanceID:  op.InstanceID,
+		ServiceID:   payload.ServiceID,
+		PlanID:      payload.PlanID,
+		AppGUID:     payload.AppGUID,
+		Parameters:  payload.Parameters,
+		Context:     payload.Context,
+		Credentials: raw,
+	})
+}
+
+// abortBind drops the user of a failed binding, the binding is unknown without its record
+func (sb *serviceBroker) abortBind(ctx context.Context, op *store.Operation) {
+	if err := sb.dropUser(ctx, op.InstanceID, op.BindingID); err != nil {
+		sb.logger.Error("drop-user", err, lager.Data{"instance": op.InstanceID, "binding": op.BindingID})
+	}
+}
+
+// GetBinding implements brokerapi.ServiceBroker
 func (sb *serviceBroker) GetBinding(ctx context.Context, instanceID, bindingID string) (brokerapi.GetBindingSpec, error) {
-	return brokerapi.GetBindingSpec{}, fmt.Errorf("Function not implemented")
+	binding, err := sb.store.Binding(ctx, instanceID, bindingID)
+	if err == store.ErrNotFound {
+		return brokerapi.GetBindingSpec{}, brokerapi.ErrBindingNotFound
+	}
+	if err != nil {
+		return brokerapi.GetBindingSpec{}, err
+	}
+
+	// bindings created before credentials were kept cannot be fetched
+	if len(binding.Credentials) == 0 {
+		return brokerapi.GetBindingSpec{}, brokerapi.ErrBindingNotFound
+	}
+
+	creds, err := credentials(binding)
+	if err != nil {
+		return brokerapi.GetBindingSpec{}, err
+	}
+
+	var params interface{}
+	if len(binding.Parameters) != 0 {
+		if err := json.Unmarshal(binding.Parameters, &params); err != nil {
+			return brokerapi.GetBindingSpec{}, err
+		}
+	}
+
+	return brokerapi.GetBindingSpec{
+		Credentials: creds,
+		Parameters:  params,
+	}, nil
 }
 
 // Unbind implements brokerapi.ServiceBroker
-func (sb *serviceBroker) Unbind(ctx context.Context, instanceID, bindingID string, _ brokerapi.UnbindDetails, asyncAllowed bool) (brokerapi.UnbindSpec, error) {
-	return brokerapi.UnbindSpec{IsAsync: false, OperationData: ""}, sb.pgp.DropUser(ctx, instanceID, bindingID)
+func (sb *serviceBroker) Unbind(ctx context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails, asyncAllowed bool) (brokerapi.UnbindSpec, error) {
+	instance, err := sb.instance(ctx, instanceID, details.ServiceID, details.PlanID)
+	if err != nil {
+		return brokerapi.UnbindSpec{}, err
+	}
+	conn, err := sb.backendOf(instance)
+	if err != nil {
+		return brokerapi.UnbindSpec{}, err
+	}
+
+	op, err := sb.inProgress(ctx, instanceID, bindingID)
+	if err != nil {
+		return brokerapi.UnbindSpec{}, err
+	}
+	if op != nil && op.Kind == opUnbind {
+		return brokerapi.UnbindSpec{IsAsync: true, OperationData: op.ID}, nil
+	}
+	if op != nil {
+		return brokerapi.UnbindSpec{}, brokerapi.ErrConcurrentInstanceAccess
+	}
+
+	// bindings created before the state store existed are only known by their users
+	if _, err := sb.store.Binding(ctx, instanceID, bindingID); err == store.ErrNotFound {
+		if !conn.UserExists(ctx, bindingID) {
+			return brokerapi.UnbindSpec{}, brokerapi.ErrBindingDoesNotExist
+		}
+	} else if err != nil {
+		return brokerapi.UnbindSpec{}, err
+	}
+
+	if asyncAllowed {
+		id, err := sb.start(ctx, opUnbind, instanceID, bindingID, nil)
+		return brokerapi.UnbindSpec{IsAsync: true, OperationData: id}, err
+	}
+	return brokerapi.UnbindSpec{IsAsync: false, OperationData: ""}, apiError(sb.perform(ctx, opUnbind, instanceID, bindingID, nil))
 }
 
-// LastOperation implements brokerapi.ServiceBroker
-func (sb *serviceBroker) LastOperation(ctx context.Context, instanceID string, details brokerapi.PollDetails) (brokerapi.LastOperation, error) {
-	var reply = brokerapi.LastOperation{State: brokerapi.InProgress, Description: "Drop DB in progress"}
-	if exists := sb.pgp.DatabaseExists(ctx, instanceID); !exists {
-		reply.State = brokerapi.Succeeded
-		reply.Description = "DROP DB Succesful"
+// runUnbind drops the user of the binding of the provided operation
+func (sb *serviceBroker) runUnbind(ctx context.Context, op *store.Operation) error {
+	if err := sb.dropUser(ctx, op.InstanceID, op.BindingID); err != nil {
+		return err
+	}
+	if err := sb.store.DeleteBinding(ctx, op.InstanceID, op.BindingID); err != nil && err != store.ErrNotFound {
+		return err
 	}
+	return nil
+}
 
-	return reply, nil
+// LastOperation implements brokerapi.ServiceBroker
+func (sb *serviceBroker) LastOperation(ctx context.Context, instanceID string, details brokerapi.PollDetails) (brokerapi.LastOperation, error) {
+	return sb.lastOperation(ctx, instanceID, "", details.OperationData)
 }
 
+// LastBindingOperation implements brokerapi.ServiceBroker
 func (sb *serviceBroker) LastBindingOperation(ctx context.Context, instanceID, bindingID string, details brokerapi.PollDetails) (brokerapi.LastOperation, error) {
-	return brokerapi.LastOperation{}, fmt.Errorf("function not implemented")
+	return sb.lastOperation(ctx, instanceID, bindingID, details.OperationData)
 }
 
 // Update implements brokerapi.ServiceBroker
-func (sb *serviceBroker) Update(ctx context.Context, instanceID string, _ brokerapi.UpdateDetails, _ bool) (brokerapi.UpdateServiceSpec, error) {
-	return brokerapi.UpdateServiceSpec{}, errors.New("updates are not supported")
+func (sb *serviceBroker) Update(ctx context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
+	planID := details.PreviousValues.PlanID
+	if planID == "" {
+		planID = details.PlanID
+	}
+
+	instance, err := sb.instance(ctx, instanceID, details.ServiceID, planID)
+	if err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+
+	if op, err := sb.inProgress(ctx, instanceID, ""); err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	} else if op != nil {
+		return brokerapi.UpdateServiceSpec{}, brokerapi.ErrConcurrentInstanceAccess
+	}
+	if busy, err := sb.bindingsInProgress(ctx, instanceID); err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	} else if busy {
+		return brokerapi.UpdateServiceSpec{}, brokerapi.ErrConcurrentInstanceAccess
+	}
+
+	updated := *instance
+	if details.PlanID != "" {
+		updated.PlanID = details.PlanID
+	}
+	if len(details.RawContext) != 0 {
+		updated.Context = details.RawContext
+	}
+
+	// parameters left out of the update keep their values
+	// as far as the target plan accepts them
+	settings := sb.catalog().planSettings(updated.PlanID)
+	if err := validateParams(planSchemas(settings).Instance.Update, details.RawParameters); err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	if updated.Parameters, err = mergeParams(instance.Parameters, details.RawParameters); err != nil {
+		return brokerapi.UpdateServiceSpec{}, brokerapi.ErrRawParamsInvalid
+	}
+	if updated.Parameters, err = adaptParams(settings, updated.Parameters); err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+
+	if updated.PlanID != instance.PlanID {
+		if err := sb.validatePlanChange(ctx, instance, details.ServiceID, updated.PlanID); err != nil {
+			return brokerapi.UpdateServiceSpec{}, err
+		}
+	}
+
+	payload := &updatePayload{
+		PlanID:     updated.PlanID,
+		Parameters: updated.Parameters,
+		Context:    updated.Context,
+	}
+
+	conn, err := sb.backendOf(instance)
+	if err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+
+	if asyncAllowed {
+		id, err := sb.start(ctx, opUpdate, instanceID, "", payload)
+		return brokerapi.UpdateServiceSpec{IsAsync: true, DashboardURL: conn.DBName(instanceID), OperationData: id}, err
+	}
+	return brokerapi.UpdateServiceSpec{DashboardURL: conn.DBName(instanceID)}, apiError(sb.perform(ctx, opUpdate, instanceID, "", payload))
+}
+
+// updatePayload is the instance state an update operation moves the instance to
+type updatePayload struct {
+	PlanID     string          `json:"plan_id"`
+	Parameters json.RawMessage `json:"parameters,omitempty"`
+	Context    json.RawMessage `json:"context,omitempty"`
+}
+
+// runUpdate applies settings of the target plan to the instance of the provided operation
+func (sb *serviceBroker) runUpdate(ctx context.Context, op *store.Operation) error {
+	payload := &updatePayload{}
+	if err := json.Unmarshal(op.Payload, payload); err != nil {
+		return err
+	}
+
+	instance, err := sb.store.Instance(ctx, op.InstanceID)
+	if err != nil {
+		return err
+	}
+
+	conn, err := sb.backendOf(instance)
+	if err != nil {
+		return err
+	}
+
+	// instances sharing a database have no database settings of their own,
+	// settings removed from parameters are reset before the plan ones apply
+	settings := sb.catalog().planSettings(payload.PlanID)
+	if instance.SharedDatabase == "" {
+		current, err := decodeInstanceParams(instance.Parameters)
+		if err != nil {
+			return err
+		}
+		params, err := decodeInstanceParams(payload.Parameters)
+		if err != nil {
+			return err
+		}
+
+		reset := make([]string, 0)
+		for name := range current.Settings {
+			if _, ok := params.Settings[name]; !ok {
+				reset = append(reset, name)
+			}
+		}
+
+		// only extensions installed by the broker are dropped
+		removed := make([]string, 0)
+		for _, name := range current.Extensions {
+			if !contains(params.Extensions, name) {
+				removed = append(removed, name)
+			}
+		}
+		if err := conn.DropExtensions(ctx, op.InstanceID, removed); err != nil {
+			return err
+		}
+		if err := conn.CreateExtensions(ctx, op.InstanceID, params.Extensions); err != nil {
+			return err
+		}
+
+		if err := conn.ConfigureDB(ctx, op.InstanceID, nil, reset); err != nil {
+			return err
+		}
+		if err := conn.AlterDB(ctx, op.InstanceID, settings.dbSettings()); err != nil {
+			return err
+		}
+		if err := conn.ConfigureDB(ctx, op.InstanceID, params.settings(), nil); err != nil {
+			return err
+		}
+	}
+
+	// existing bindings get connection limits of the new plan,
+	// owner ones privileges as well
+	bindings, err := sb.store.Bindings(ctx, op.InstanceID)
+	if err != nil {
+		return err
+	}
+	for _, b := range bindings {
+		params, err := decodeBindParams(b.Parameters)
+		if err != nil {
+			return err
+		}
+		if params.Role == pgp.RoleOwner && instance.SharedDatabase == "" {
+			if err := conn.GrantDB(ctx, op.InstanceID, b.ID, settings.privileges()); err != nil {
+				return err
+			}
+		}
+
+		creds, err := credentials(b)
+		if err != nil {
+			return err
+		}
+		if err := limitUser(ctx, conn, settings, b.ID, params, creds); err != nil {
+			return err
+		}
+		raw, err := json.Marshal(creds)
+		if err != nil {
+			return err
+		}
+		if err := sb.store.UpdateCredentials(ctx, op.InstanceID, b.ID, raw); err != nil {
+			return err
+		}
+	}
+
+	instance.PlanID, instance.Parameters, instance.Context = payload.PlanID, payload.Parameters, payload.Context
+	return sb.store.UpdateInstance(ctx, instance)
+}
+
+// instance fetches the named instance, databases provisioned before the state
+// store existed are adopted into it with the provided service and plan
+func (sb *serviceBroker) instance(ctx context.Context, instanceID, serviceID, planID string) (*store.Instance, error) {
+	instance, err := sb.store.Instance(ctx, instanceID)
+	if err != store.ErrNotFound {
+		return instance, err
+	}
+
+	backend := sb.legacyBackend(ctx, instanceID)
+	if backend == nil {
+		return nil, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	sb.logger.Info("adopt-instance", lager.Data{"instance": instanceID, "plan": planID, "backend": backend.Name})
+	if err := sb.store.CreateInstance(ctx, &store.Instance{
+		ID:        instanceID,
+		ServiceID: serviceID,
+		PlanID:    planID,
+		Backend:   backend.Name,
+	}); err != nil && err != store.ErrExists {
+		return nil, err
+	}
+	return sb.store.Instance(ctx, instanceID)
+}
+
+// dropInstance drops the database, or the schema in the shared database, of the provided instance
+func (sb *serviceBroker) dropInstance(ctx context.Context, instance *store.Instance) error {
+	conn, err := sb.backendOf(instance)
+	if err != nil {
+		return err
+	}
+
+	if instance.SharedDatabase != "" {
+		return conn.DropSchema(ctx, instance.SharedDatabase, instance.ID)
+	}
+	return conn.DropDB(ctx, instance.ID)
+}
+
+// dropUser drops the user of the named binding wherever its instance lives,
+// users of deprovisioned instances have been dropped along with them
+func (sb *serviceBroker) dropUser(ctx context.Context, instanceID, bindingID string) error {
+	instance, err := sb.store.Instance(ctx, instanceID)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	conn, err := sb.backendOf(instance)
+	if err != nil {
+		return err
+	}
+
+	if instance.SharedDatabase != "" {
+		return conn.DropSchemaUser(ctx, instance.SharedDatabase, instanceID, bindingID)
+	}
+	return conn.DropUser(ctx, instanceID, bindingID)
+}
+
+// validatePlanChange checks whether the provided instance can be moved to the named plan
+func (sb *serviceBroker) validatePlanChange(ctx context.Context, instance *store.Instance, serviceID, planID string) error {
+	c := sb.catalog()
+	if serviceID != instance.ServiceID || !c.planUpdatable(serviceID, instance.PlanID) {
+		return brokerapi.ErrPlanChangeNotSupported
+	}
+	if _, ok := c.plan(serviceID, planID); !ok {
+		return brokerapi.ErrPlanChangeNotSupported
+	}
+
+	// databases cannot be moved between backends nor in and out of shared databases
+	settings := c.planSettings(planID)
+	backend, err := sb.backend(instance.Backend)
+	if err != nil {
+		return err
+	}
+	if !settings.eligible(backend.backendConfig) {
+		return brokerapi.ErrPlanChangeNotSupported.AppendErrorMessage("the target plan is served by other backends")
+	}
+	if settings.sharedDatabase() != instance.SharedDatabase {
+		return brokerapi.ErrPlanChangeNotSupported.AppendErrorMessage("the target plan places instances in another database")
+	}
+
+	// a downgrade must fit into the target plan quota
+	if settings.MaxSizeMB != 0 {
+		size, err := sb.instanceSize(ctx, instance)
+		if err != nil {
+			return err
+		}
+		if size > settings.MaxSizeMB<<20 {
+			return brokerapi.ErrPlanChangeNotSupported.AppendErrorMessage(
+				fmt.Sprintf("the database size exceeds %dMB quota of the target plan", settings.MaxSizeMB))
+		}
+	}
+	return nil
+}
+
+// credentials decodes credentials of the provided binding
+func credentials(b *store.Binding) (*pgp.Credentials, error) {
+	creds := &pgp.Credentials{}
+	if err := json.Unmarshal(b.Credentials, creds); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// contains checks whether the named list contains the named string
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// limitUser applies connection limits of a plan with the provided settings to
+// the user of the named binding and reports them in the provided credentials
+func limitUser(ctx context.Context, conn *pgp.PGP, settings planSettings, bindingID string, params *bindParams, creds *pgp.Credentials) error {
+	limit := settings.bindingConnections(params)
+	if err := conn.LimitUser(ctx, bindingID, limit); err != nil {
+		return err
+	}
+
+	creds.ConnectionLimit, creds.DatabaseConnectionLimit = nil, nil
+	if limit != -1 {
+		creds.ConnectionLimit = &limit
+	}
+	if settings.ConnectionLimit != nil && *settings.ConnectionLimit != -1 {
+		dbLimit := *settings.ConnectionLimit
+		creds.DatabaseConnectionLimit = &dbLimit
+	}
+	return nil
+}
+
+// instanceSize returns size of the database, or of the schema in the shared database, of the provided instance
+func (sb *serviceBroker) instanceSize(ctx context.Context, instance *store.Instance) (int64, error) {
+	conn, err := sb.backendOf(instance)
+	if err != nil {
+		return 0, err
+	}
+
+	if instance.SharedDatabase != "" {
+		return conn.SchemaSize(ctx, instance.SharedDatabase, instance.ID)
+	}
+	return conn.DatabaseSize(ctx, instance.ID)
+}
+
+// sameInstance checks whether the provided instances are provisioned with identical details
+func sameInstance(a, b *store.Instance) bool {
+	return a.ServiceID == b.ServiceID &&
+		a.PlanID == b.PlanID &&
+		a.OrganizationGUID == b.OrganizationGUID &&
+		a.SpaceGUID == b.SpaceGUID &&
+		sameJSON(a.Parameters, b.Parameters)
+}
+
+// sameBinding checks whether the provided binding has been created with the provided details
+func sameBinding(b *store.Binding, details brokerapi.BindDetails) bool {
+	return b.ServiceID == details.ServiceID &&
+		b.PlanID == details.PlanID &&
+		b.AppGUID == details.AppGUID &&
+		sameJSON(b.Parameters, details.RawParameters)
+}
+
+// sameJSON checks whether the provided JSON documents are semantically equal,
+// blank documents are considered equal to empty objects
+func sameJSON(a, b json.RawMessage) bool {
+	var x, y interface{} = map[string]interface{}{}, map[string]interface{}{}
+	if len(a) != 0 && json.Unmarshal(a, &x) != nil {
+		return false
+	}
+	if len(b) != 0 && json.Unmarshal(b, &y) != nil {
+		return false
+	}
+	return reflect.DeepEqual(x, y)
 }
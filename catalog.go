@@ -0,0 +1,674 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/vchrisr/cf-postgresql-broker/pgp"
+)
+
+// defaultBackend is the name of the backend when no backends are configured
+const defaultBackend = "default"
+
+// placement strategies choosing the backend of new instances
+const (
+	// placeLeastDatabases picks the backend with the fewest instances
+	placeLeastDatabases = "least-databases"
+	// placeLeastDisk picks the backend with the least disk used by databases
+	placeLeastDisk = "least-disk"
+	// placeRoundRobin picks backends in turns
+	placeRoundRobin = "round-robin"
+)
+
+// plan modes
+const (
+	// modeDatabase plans create a database per instance
+	modeDatabase = "database"
+	// modeSchema plans create a schema per instance in a shared database
+	modeSchema = "schema"
+)
+
+// defaultSharedDatabase is the database schemas of schema mode plans are created in
+const defaultSharedDatabase = "sb_shared"
+
+// databasePrivileges are privileges that can be granted on a database
+var databasePrivileges = map[string]bool{
+	"ALL":       true,
+	"CREATE":    true,
+	"CONNECT":   true,
+	"TEMPORARY": true,
+	"TEMP":      true,
+}
+
+// catalog is the list of offered services along with broker-side settings of their plans
+type catalog struct {
+	services []brokerapi.Service
+	settings map[string]planSettings
+
+	// updatable tells by plan ID whether instances of the plan may change plans
+	updatable map[string]bool
+
+	// seeds are SQL scripts new databases may be seeded with by name
+	seeds map[string]string
+
+	// masking are rules of the operator policy every clone is scrubbed with
+	masking []maskRule
+}
+
+// planSettings are broker-side settings of a plan, they're read
+// from the "settings" key of every plan in the services list
+type planSettings struct {
+	// Backend pins the plan instances to the named backend
+	Backend string `json:"backend"`
+
+	// BackendLabels restrict the plan instances to backends having all of the labels
+	BackendLabels map[string]string `json:"backend_labels"`
+
+	// Placement is the strategy choosing a backend among the eligible ones, least-databases by default
+	Placement string `json:"placement"`
+
+	// Mode is either database or schema, database by default
+	Mode string `json:"mode"`
+
+	// SharedDatabase is the database schema mode instances are created in
+	SharedDatabase string `json:"shared_database"`
+
+	// ConnectionLimit limits concurrent connections to the database, blank is unlimited
+	ConnectionLimit *int `json:"connection_limit"`
+
+	// BindingConnectionLimit limits concurrent connections of every binding user
+	// unless bind parameters lower it, blank is limited by ConnectionLimit only
+	BindingConnectionLimit *int `json:"binding_connection_limit"`
+
+	// StatementTimeout is the default statement_timeout of the database, blank is the server default
+	StatementTimeout string `json:"statement_timeout"`
+
+	// Encoding, LCCollate and LCCtype of the database, blank inherit the template ones
+	Encoding  string `json:"encoding"`
+	LCCollate string `json:"lc_collate"`
+	LCCtype   string `json:"lc_ctype"`
+
+	// ICULocale makes the plan databases use the ICU locale provider with the named locale
+	ICULocale string `json:"icu_locale"`
+
+	// Template is the database the plan databases are copied from
+	Template string `json:"template"`
+
+	// Seed names the SQL script the plan databases are seeded with
+	Seed string `json:"seed"`
+
+	// Seeds name the SQL scripts provision parameters may choose instead
+	Seeds []string `json:"seeds"`
+
+	// Extensions that may be installed in the database, blank allows none
+	Extensions []string `json:"extensions"`
+
+	// Privileges on the database granted to every binding, blank grants ALL
+	Privileges []string `json:"privileges"`
+
+	// MaxSizeMB is the database size quota in megabytes, zero is unlimited
+	MaxSizeMB int64 `json:"max_size_mb"`
+
+	// AllowedSettings are runtime settings instances may change with parameters
+	AllowedSettings map[string]settingRule `json:"allowed_settings"`
+
+	// Backups schedules logical backups of the plan databases, blank takes none
+	Backups *backupPolicy `json:"backups"`
+}
+
+// backupPolicy is the schedule and the retention of logical backups of instances
+type backupPolicy struct {
+	// Interval between backups of an instance, e.g. 24h
+	Interval string `json:"interval"`
+
+	// Keep is the number of most recent backups kept, zero keeps all
+	Keep int `json:"keep"`
+
+	// MaxAge expires backups older than it, e.g. 720h, blank keeps them,
+	// the most recent backup is kept regardless
+	MaxAge string `json:"max_age"`
+
+	// RetainDeprovisioned is how long backups of deprovisioned instances
+	// are kept, e.g. 720h, blank keeps them for defaultRetainDeprovisioned
+	RetainDeprovisioned string `json:"retain_deprovisioned"`
+}
+
+// minBackupInterval is the shortest interval between backups of an instance
+const minBackupInterval = time.Hour
+
+// defaultRetainDeprovisioned is how long backups of deprovisioned instances are kept by default
+const defaultRetainDeprovisioned = 7 * 24 * time.Hour
+
+// validate checks the policy durations
+func (p *backupPolicy) validate() error {
+	interval, err := time.ParseDuration(p.Interval)
+	if err != nil {
+		return fmt.Errorf("backups.interval: %v", err)
+	}
+	if interval < minBackupInterval {
+		return fmt.Errorf("backups.interval %s is shorter than %s", p.Interval, minBackupInterval)
+	}
+	if p.Keep < 0 {
+		return fmt.Errorf("backups.keep %d is invalid", p.Keep)
+	}
+	if p.MaxAge != "" {
+		if maxAge, err := time.ParseDuration(p.MaxAge); err != nil {
+			return fmt.Errorf("backups.max_age: %v", err)
+		} else if maxAge <= 0 {
+			return fmt.Errorf("backups.max_age %s is invalid", p.MaxAge)
+		}
+	}
+	if p.RetainDeprovisioned != "" {
+		if retain, err := time.ParseDuration(p.RetainDeprovisioned); err != nil {
+			return fmt.Errorf("backups.retain_deprovisioned: %v", err)
+		} else if retain <= 0 {
+			return fmt.Errorf("backups.retain_deprovisioned %s is invalid", p.RetainDeprovisioned)
+		}
+	}
+	return nil
+}
+
+// interval returns the interval between backups, the policy is expected to be valid
+func (p *backupPolicy) interval() time.Duration {
+	d, _ := time.ParseDuration(p.Interval)
+	return d
+}
+
+// maxAge returns the age backups expire at, zero when they don't
+func (p *backupPolicy) maxAge() time.Duration {
+	d, _ := time.ParseDuration(p.MaxAge)
+	return d
+}
+
+// retainDeprovisioned returns how long backups of deprovisioned instances are
+// kept, the default applies to plans without backups or gone from the catalog
+func (p *backupPolicy) retainDeprovisioned() time.Duration {
+	if p == nil || p.RetainDeprovisioned == "" {
+		return defaultRetainDeprovisioned
+	}
+	d, _ := time.ParseDuration(p.RetainDeprovisioned)
+	return d
+}
+
+// settingRule constrains values of a runtime setting instances may change,
+// integers are in the setting base unit, e.g. milliseconds or kilobytes
+type settingRule struct {
+	// Type is one of integer, string and boolean
+	Type string `json:"type"`
+
+	// Minimum and Maximum bound integer values
+	Minimum *int64 `json:"minimum"`
+	Maximum *int64 `json:"maximum"`
+
+	// Enum and Pattern restrict string values
+	Enum    []string `json:"enum"`
+	Pattern string   `json:"pattern"`
+}
+
+// settingName matches names of runtime settings including custom ones
+var settingName = regexp.MustCompile(`^[a-z_][a-z0-9_]*(\.[a-z_][a-z0-9_]*)?$`)
+
+// reservedSettings are runtime settings the broker relies on
+var reservedSettings = map[string]bool{
+	"default_transaction_read_only": true,
+	"role":                          true,
+	"search_path":                   true,
+	"session_authorization":         true,
+}
+
+// validate checks the rule of the named setting
+func (r settingRule) validate(name string) error {
+	if !settingName.MatchString(name) {
+		return fmt.Errorf("allowed_settings: setting name %q is invalid", name)
+	}
+	if reservedSettings[name] {
+		return fmt.Errorf("allowed_settings: setting %q is managed by the broker", name)
+	}
+
+	switch r.Type {
+	case "integer":
+		if r.Enum != nil || r.Pattern != "" {
+			return fmt.Errorf("allowed_settings.%s: enum and pattern require string type", name)
+		}
+		if r.Minimum != nil && r.Maximum != nil && *r.Minimum > *r.Maximum {
+			return fmt.Errorf("allowed_settings.%s: minimum is greater than maximum", name)
+		}
+	case "string":
+		if r.Minimum != nil || r.Maximum != nil {
+			return fmt.Errorf("allowed_settings.%s: minimum and maximum require integer type", name)
+		}
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			return fmt.Errorf("allowed_settings.%s: pattern is invalid: %v", name, err)
+		}
+	case "boolean":
+		if r.Enum != nil || r.Pattern != "" || r.Minimum != nil || r.Maximum != nil {
+			return fmt.Errorf("allowed_settings.%s: boolean settings cannot be constrained", name)
+		}
+	default:
+		return fmt.Errorf("allowed_settings.%s: type %q is invalid", name, r.Type)
+	}
+	return nil
+}
+
+// schema builds the JSON schema of values of the setting
+func (r settingRule) schema() map[string]interface{} {
+	schema := map[string]interface{}{"type": r.Type}
+	if r.Minimum != nil {
+		schema["minimum"] = *r.Minimum
+	}
+	if r.Maximum != nil {
+		schema["maximum"] = *r.Maximum
+	}
+	if r.Enum != nil {
+		schema["enum"] = r.Enum
+	}
+	if r.Pattern != "" {
+		schema["pattern"] = r.Pattern
+	}
+	return schema
+}
+
+// placeholder matches placeholders left in IDs
+var placeholder = regexp.MustCompile(`\{[A-Za-z_]+\}`)
+
+// newCatalog builds the catalog from the provided services replacing {GUID}
+// with its runtime value, all problems found are reported at once
+func newCatalog(services []serviceConfig, GUID string) (*catalog, error) {
+	// replace func
+	replace := func(str string) string {
+		if GUID == "" {
+			return str
+		}
+		return strings.Replace(str, "{GUID}", GUID, -1)
+	}
+
+	c := &catalog{
+		services:  make([]brokerapi.Service, len(services)),
+		settings:  make(map[string]planSettings),
+		updatable: make(map[string]bool),
+	}
+
+	errs := validationError{}
+	serviceIDs := make(map[string]bool)
+	serviceNames := make(map[string]bool)
+	planIDs := make(map[string]bool)
+	for i, sc := range services {
+		path := fmt.Sprintf("services[%d]", i)
+		service := sc.Service
+		service.ID = replace(service.ID)
+		service.InstancesRetrievable = true
+		service.BindingsRetrievable = true
+		service.Plans = make([]brokerapi.ServicePlan, len(sc.Plans))
+
+		errs = append(errs, validateEntry(path, "service", service.ID, service.Name, service.Description, serviceIDs, serviceNames)...)
+		if len(sc.Plans) == 0 {
+			errs = append(errs, path+": plans are required")
+		}
+
+		planNames := make(map[string]bool)
+		for j, pc := range sc.Plans {
+			path := fmt.Sprintf("%s.plans[%d]", path, j)
+			plan := pc.ServicePlan
+			plan.ID = replace(plan.ID)
+
+			// plan IDs are unique across the whole catalog, names within a service
+			errs = append(errs, validateEntry(path, "plan", plan.ID, plan.Name, plan.Description, planIDs, planNames)...)
+
+			c.updatable[plan.ID] = service.PlanUpdatable
+			if pc.PlanUpdateable != nil {
+				c.updatable[plan.ID] = *pc.PlanUpdateable
+			}
+
+			settings := planSettings{}
+			if len(pc.Settings) != 0 {
+				if err := decodeStrict(pc.Settings, &settings); err != nil {
+					errs = append(errs, fmt.Sprintf("%s.settings: %v", path, err))
+				}
+			}
+			if settings.Placement == "" {
+				settings.Placement = placeLeastDatabases
+			}
+			if settings.Mode == "" {
+				settings.Mode = modeDatabase
+			}
+			if settings.Mode == modeSchema && settings.SharedDatabase == "" {
+				settings.SharedDatabase = defaultSharedDatabase
+			}
+			if err := settings.validate(); err != nil {
+				errs = append(errs, fmt.Sprintf("%s.settings: %v", path, err))
+			}
+
+			// parameters schemas are derived from the settings
+			plan.Schemas = planSchemas(settings)
+			service.Plans[j] = plan
+			if _, ok := c.settings[plan.ID]; !ok {
+				c.settings[plan.ID] = settings
+			}
+		}
+		c.services[i] = service
+	}
+
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	return c, nil
+}
+
+// validateEntry checks ID, name and description of a catalog entry
+// recording the ID and the name to detect duplicates
+func validateEntry(path, kind, id, name, description string, ids, names map[string]bool) []string {
+	errs := make([]string, 0)
+	switch {
+	case id == "":
+		errs = append(errs, path+": "+kind+" id is required")
+	case placeholder.MatchString(id):
+		errs = append(errs, fmt.Sprintf("%s: %s id %q has unresolved %s", path, kind, id, placeholder.FindString(id)))
+	case ids[id]:
+		errs = append(errs, fmt.Sprintf("%s: duplicate %s id %q", path, kind, id))
+	}
+	ids[id] = true
+
+	switch {
+	case name == "":
+		errs = append(errs, path+": "+kind+" name is required")
+	case names[name]:
+		errs = append(errs, fmt.Sprintf("%s: duplicate %s name %q", path, kind, name))
+	}
+	names[name] = true
+
+	if description == "" {
+		errs = append(errs, path+": "+kind+" description is required")
+	}
+	return errs
+}
+
+// service looks up the named service
+func (c *catalog) service(serviceID string) (brokerapi.Service, bool) {
+	for _, s := range c.services {
+		if s.ID == serviceID {
+			return s, true
+		}
+	}
+	return brokerapi.Service{}, false
+}
+
+// plan looks up the named plan of the named service
+func (c *catalog) plan(serviceID, planID string) (brokerapi.ServicePlan, bool) {
+	s, ok := c.service(serviceID)
+	if !ok {
+		return brokerapi.ServicePlan{}, false
+	}
+	for _, p := range s.Plans {
+		if p.ID == planID {
+			return p, true
+		}
+	}
+	return brokerapi.ServicePlan{}, false
+}
+
+// planUpdatable checks whether instances of the named plan of the named service
+// may change plans, plan_updateable of the plan overrides the one of the service
+// which applies to plans that are not in the catalog anymore as well
+func (c *catalog) planUpdatable(serviceID, planID string) bool {
+	if updatable, ok := c.updatable[planID]; ok {
+		return updatable
+	}
+	service, ok := c.service(serviceID)
+	return ok && service.PlanUpdatable
+}
+
+// planSettings returns settings of the named plan, plans that are not
+// in the catalog anymore fall back to the default settings
+func (c *catalog) planSettings(planID string) planSettings {
+	if s, ok := c.settings[planID]; ok {
+		return s
+	}
+	return planSettings{Placement: placeLeastDatabases, Mode: modeDatabase}
+}
+
+// validatePlacement checks that every plan can place its instances on one of the provided backends
+func (c *catalog) validatePlacement(backends []backendConfig) []string {
+	errs := make([]string, 0)
+	for _, service := range c.services {
+		for _, plan := range service.Plans {
+			settings := c.settings[plan.ID]
+			eligible := false
+			for _, b := range backends {
+				if settings.eligible(b) {
+					eligible = true
+					break
+				}
+			}
+			if !eligible {
+				errs = append(errs, fmt.Sprintf("plan %q: no backend matches backend %q and backend_labels %v",
+					plan.ID, settings.Backend, settings.BackendLabels))
+			}
+		}
+	}
+	return errs
+}
+
+// validateSeeds checks that seeds of every plan are among the provided ones
+func (c *catalog) validateSeeds(seeds map[string]string) []string {
+	errs := make([]string, 0)
+	for _, service := range c.services {
+		for _, plan := range service.Plans {
+			settings := c.settings[plan.ID]
+			for _, name := range append([]string{settings.Seed}, settings.Seeds...) {
+				if _, ok := seeds[name]; name != "" && !ok {
+					errs = append(errs, fmt.Sprintf("plan %q: unknown seed %q", plan.ID, name))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// validateBackups checks that plans taking backups have a store to keep them in
+// and pg_dump to take them with, dump is the error looking pg_dump up
+func (c *catalog) validateBackups(configured bool, dump error) []string {
+	errs := make([]string, 0)
+	for _, service := range c.services {
+		for _, plan := range service.Plans {
+			switch {
+			case c.settings[plan.ID].Backups == nil:
+			case !configured:
+				errs = append(errs, fmt.Sprintf("plan %q: backups require a backup_store", plan.ID))
+			case dump != nil:
+				errs = append(errs, fmt.Sprintf("plan %q: backups require %s: %v", plan.ID, pgp.DumpCommand, dump))
+			}
+		}
+	}
+	return errs
+}
+
+// validate checks settings that end up in SQL statements
+func (s planSettings) validate() error {
+	if s.ConnectionLimit != nil && *s.ConnectionLimit < -1 {
+		return fmt.Errorf("connection_limit %d is invalid", *s.ConnectionLimit)
+	}
+	if s.BindingConnectionLimit != nil && *s.BindingConnectionLimit < -1 {
+		return fmt.Errorf("binding_connection_limit %d is invalid", *s.BindingConnectionLimit)
+	}
+	if s.MaxSizeMB < 0 {
+		return fmt.Errorf("max_size_mb %d is invalid", s.MaxSizeMB)
+	}
+	for _, p := range s.Privileges {
+		if !databasePrivileges[strings.ToUpper(p)] {
+			return fmt.Errorf("privilege %q cannot be granted on a database", p)
+		}
+	}
+
+	for name, rule := range s.AllowedSettings {
+		if err := rule.validate(name); err != nil {
+			return err
+		}
+	}
+	if s.Backups != nil {
+		if err := s.Backups.validate(); err != nil {
+			return err
+		}
+	}
+
+	switch s.Placement {
+	case placeLeastDatabases, placeLeastDisk, placeRoundRobin:
+	default:
+		return fmt.Errorf("placement %q is invalid", s.Placement)
+	}
+
+	switch s.Mode {
+	case modeDatabase:
+		if s.SharedDatabase != "" {
+			return errors.New("shared_database requires schema mode")
+		}
+	case modeSchema:
+		// instances sharing a database cannot have database settings of their own
+		switch {
+		case s.ConnectionLimit != nil:
+			return errors.New("connection_limit is not supported in schema mode")
+		case s.StatementTimeout != "":
+			return errors.New("statement_timeout is not supported in schema mode")
+		case s.Encoding != "", s.LCCollate != "", s.LCCtype != "", s.ICULocale != "", s.Template != "":
+			return errors.New("encoding, locale and template are not supported in schema mode")
+		case s.Seed != "", s.Seeds != nil:
+			return errors.New("seeds are not supported in schema mode")
+		case s.Extensions != nil:
+			return errors.New("extensions are not supported in schema mode")
+		case s.Privileges != nil:
+			return errors.New("privileges are not supported in schema mode")
+		case s.AllowedSettings != nil:
+			return errors.New("allowed_settings are not supported in schema mode")
+		case s.Backups != nil:
+			return errors.New("backups are not supported in schema mode")
+		}
+	default:
+		return fmt.Errorf("mode %q is invalid", s.Mode)
+	}
+	return nil
+}
+
+// eligible checks whether the plan instances may be placed on the provided backend
+func (s planSettings) eligible(b backendConfig) bool {
+	if s.Backend != "" && s.Backend != b.Name {
+		return false
+	}
+	for k, v := range s.BackendLabels {
+		if l, ok := b.Labels[k]; !ok || l != v {
+			return false
+		}
+	}
+	return true
+}
+
+// sharedDatabase returns the database instances of the plan
+// share, blank when every instance gets a database of its own
+func (s planSettings) sharedDatabase() string {
+	if s.Mode != modeSchema {
+		return ""
+	}
+	return s.SharedDatabase
+}
+
+// dbOptions converts plan settings to database creation options,
+// the provided provision parameters override them
+func (s planSettings) dbOptions(p *instanceParams) pgp.DBOptions {
+	opts := pgp.DBOptions{
+		Encoding:  s.Encoding,
+		LCCollate: s.LCCollate,
+		LCCtype:   s.LCCtype,
+		ICULocale: s.ICULocale,
+		Template:  s.Template,
+	}
+	for _, o := range []struct {
+		param  string
+		option *string
+	}{
+		{p.Encoding, &opts.Encoding},
+		{p.LCCollate, &opts.LCCollate},
+		{p.LCCtype, &opts.LCCtype},
+		{p.ICULocale, &opts.ICULocale},
+		{p.Template, &opts.Template},
+	} {
+		if o.param != "" {
+			*o.option = o.param
+		}
+	}
+	return opts
+}
+
+// dbSettings converts plan settings to database settings
+func (s planSettings) dbSettings() pgp.DBSettings {
+	limit := -1
+	if s.ConnectionLimit != nil {
+		limit = *s.ConnectionLimit
+	}
+
+	return pgp.DBSettings{
+		ConnectionLimit:  limit,
+		StatementTimeout: s.StatementTimeout,
+	}
+}
+
+// seed returns name of the seed of a database created
+// with the provided parameters, blank when there's none
+func (s planSettings) seed(p *instanceParams) string {
+	if p.Seed != "" {
+		return p.Seed
+	}
+	return s.Seed
+}
+
+// maxBindingConnections returns the highest connection limit of a binding
+// user, the lower one of the plan limits or -1 when both are unlimited
+func (s planSettings) maxBindingConnections() int {
+	max := -1
+	for _, limit := range []*int{s.ConnectionLimit, s.BindingConnectionLimit} {
+		if limit != nil && *limit != -1 && (max == -1 || *limit < max) {
+			max = *limit
+		}
+	}
+	return max
+}
+
+// bindingConnections returns the connection limit of a binding user with the
+// provided parameters, limits above the plan ones are lowered to them
+func (s planSettings) bindingConnections(p *bindParams) int {
+	limit := -1
+	if p.ConnectionLimit != nil {
+		limit = *p.ConnectionLimit
+	}
+
+	max := s.maxBindingConnections()
+	if max != -1 && (limit == -1 || limit > max) {
+		limit = max
+	}
+	return limit
+}
+
+// privileges returns privileges on the database granted to bindings
+func (s planSettings) privileges() []string {
+	if len(s.Privileges) == 0 {
+		return []string{"ALL"}
+	}
+
+	privileges := make([]string, len(s.Privileges))
+	for i, p := range s.Privileges {
+		privileges[i] = strings.ToUpper(p)
+	}
+	return privileges
+}
+
+// disallowedExtension returns the first of the named extensions requested by
+// parameters the plan doesn't allow, plans without extensions allow none
+func (s planSettings) disallowedExtension(extensions []string) (string, bool) {
+	for _, name := range extensions {
+		if s.sharedDatabase() != "" || !contains(s.Extensions, name) {
+			return name, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// config is the broker configuration, it's read either from a JSON
+// file or from the environment variables
+type config struct {
+	// Port the broker listens on
+	Port string `json:"port"`
+
+	// Source is the PostgreSQL server URL, it keeps the broker state
+	// and it's the only backend when no backends are configured
+	Source string `json:"source"`
+
+	// Backends are the PostgreSQL servers instances are placed on
+	Backends []backendConfig `json:"backends"`
+
+	// GUID replaces {GUID} in service and plan IDs
+	GUID string `json:"guid"`
+
+	// Seeds are SQL files new databases may be seeded with by name, relative
+	// paths are resolved against the configuration file directory
+	Seeds map[string]string `json:"seeds"`
+
+	// seeds are contents of the seed files
+	seeds map[string]string
+
+	// MaskingPolicy is a JSON file of masking rules every clone is scrubbed with,
+	// a relative path is resolved against the configuration file directory
+	MaskingPolicy string `json:"masking_policy"`
+
+	// masking are the rules of the masking policy
+	masking []maskRule
+
+	// BackupStore is where backups of plans with backups are kept
+	BackupStore *backupStoreConfig `json:"backup_store"`
+
+	// CredentialsSecret encrypts binding credentials kept in the state store
+	CredentialsSecret string `json:"credentials_secret"`
+
+	// Auth are basic auth credentials of the broker API
+	Auth struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auth"`
+
+	// Services is the catalog of offered services
+	Services []serviceConfig `json:"-"`
+}
+
+// backendConfig is a PostgreSQL server instances are placed on
+type backendConfig struct {
+	// Name identifies the backend in plan settings and in the broker state, never rename it
+	Name string `json:"name"`
+
+	// Source is the PostgreSQL server URL
+	Source string `json:"source"`
+
+	// Labels are matched against backend_labels of plans
+	Labels map[string]string `json:"labels"`
+}
+
+// backupStoreConfig is the object store backups are kept in
+type backupStoreConfig struct {
+	// Type is either fs or s3
+	Type string `json:"type"`
+
+	// Path is the directory of the fs store
+	Path string `json:"path"`
+
+	// Endpoint is the URL of an S3 compatible store, AWS when blank
+	Endpoint string `json:"endpoint"`
+
+	// Region, Bucket and credentials of the s3 store
+	Region          string `json:"region"`
+	Bucket          string `json:"bucket"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+}
+
+// backup store types
+const (
+	backupStoreFS = "fs"
+	backupStoreS3 = "s3"
+)
+
+// validate reports settings the store type requires that are missing
+func (c *backupStoreConfig) validate() []string {
+	errs := make([]string, 0)
+	switch c.Type {
+	case backupStoreFS:
+		if c.Path == "" {
+			errs = append(errs, "backup_store: path is required")
+		}
+	case backupStoreS3:
+		if c.Region == "" || c.Bucket == "" {
+			errs = append(errs, "backup_store: region and bucket are required")
+		}
+		if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+			errs = append(errs, "backup_store: access_key_id and secret_access_key are required")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("backup_store: type %q is invalid", c.Type))
+	}
+	return errs
+}
+
+// serviceConfig is a catalog service along with its plans
+type serviceConfig struct {
+	brokerapi.Service
+	Plans []planConfig `json:"plans"`
+}
+
+// planConfig is a catalog plan along with its broker-side settings
+type planConfig struct {
+	brokerapi.ServicePlan
+	Settings json.RawMessage `json:"settings"`
+
+	// PlanUpdateable overrides plan_updateable of the service for instances of the plan
+	PlanUpdateable *bool `json:"plan_updateable"`
+}
+
+// validationError lists all problems found in a configuration
+type validationError []string
+
+// Error implements error
+func (e validationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// loadConfig reads the named JSON configuration file, unlike
+// the environment configuration unknown keys are rejected
+func loadConfig(path string) (*config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := struct {
+		config
+		Services json.RawMessage `json:"services"`
+	}{}
+	if err := decodeStrict(b, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	// the platform assigns the port to listen on
+	cfg := &file.config
+	if port := os.Getenv("PORT"); port != "" {
+		cfg.Port = port
+	}
+	if cfg.Port == "" {
+		cfg.Port = "8080"
+	}
+	if cfg.GUID == "" {
+		cfg.GUID = os.Getenv("CF_INSTANCE_GUID")
+	}
+
+	if len(file.Services) == 0 {
+		return nil, validationError{"services are required"}
+	}
+	if cfg.Services, err = parseServices(file.Services, true); err != nil {
+		return nil, err
+	}
+	if err := cfg.readSeeds(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	if err := cfg.readMaskingPolicy(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	return cfg, cfg.validate()
+}
+
+// configFromEnv reads configuration from the environment variables
+func configFromEnv() (*config, error) {
+	cfg := &config{
+		Port:              os.Getenv("PORT"),
+		Source:            os.Getenv("PG_SOURCE"),
+		GUID:              os.Getenv("CF_INSTANCE_GUID"),
+		CredentialsSecret: os.Getenv("CREDENTIALS_SECRET"),
+		MaskingPolicy:     os.Getenv("PG_MASKING_POLICY"),
+	}
+	cfg.Auth.Username = os.Getenv("BASIC_AUTH_USERNAME")
+	cfg.Auth.Password = os.Getenv("BASIC_AUTH_PASSWORD")
+
+	if cfg.Port == "" {
+		cfg.Port = "8080"
+	}
+
+	var err error
+	if cfg.Services, err = parseServices([]byte(os.Getenv("PG_SERVICES")), false); err != nil {
+		return nil, fmt.Errorf("PG_SERVICES: %v", err)
+	}
+	if backends := os.Getenv("PG_BACKENDS"); backends != "" {
+		if err := json.Unmarshal([]byte(backends), &cfg.Backends); err != nil {
+			return nil, fmt.Errorf("PG_BACKENDS: %v", err)
+		}
+	}
+	if store := os.Getenv("PG_BACKUP_STORE"); store != "" {
+		if err := json.Unmarshal([]byte(store), &cfg.BackupStore); err != nil {
+			return nil, fmt.Errorf("PG_BACKUP_STORE: %v", err)
+		}
+	}
+	if seeds := os.Getenv("PG_SEEDS"); seeds != "" {
+		if err := json.Unmarshal([]byte(seeds), &cfg.Seeds); err != nil {
+			return nil, fmt.Errorf("PG_SEEDS: %v", err)
+		}
+	}
+	if err := cfg.readSeeds("."); err != nil {
+		return nil, err
+	}
+	if err := cfg.readMaskingPolicy("."); err != nil {
+		return nil, err
+	}
+	return cfg, cfg.validate()
+}
+
+// readSeeds reads contents of the seed files, relative
+// paths are resolved against the named directory
+func (c *config) readSeeds(dir string) error {
+	c.seeds = make(map[string]string, len(c.Seeds))
+	for name, path := range c.Seeds {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("seeds.%s: %v", name, err)
+		}
+		c.seeds[name] = string(b)
+	}
+	return nil
+}
+
+// readMaskingPolicy reads rules of the masking policy file, a relative
+// path is resolved against the named directory
+func (c *config) readMaskingPolicy(dir string) error {
+	c.masking = nil
+	if c.MaskingPolicy == "" {
+		return nil
+	}
+
+	path := c.MaskingPolicy
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("masking_policy: %v", err)
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return fmt.Errorf("masking_policy: %v", err)
+	}
+	schema := map[string]interface{}{"type": "array", "items": maskRuleSchema()}
+	errs := validateSchema(schema, v, "masking_policy")
+	if len(errs) == 0 {
+		if err := json.Unmarshal(b, &c.masking); err != nil {
+			return fmt.Errorf("masking_policy: %v", err)
+		}
+		errs = validateMaskRules(c.masking, "masking_policy")
+	}
+	if len(errs) != 0 {
+		return validationError(errs)
+	}
+	return nil
+}
+
+// parseServices decodes the named services list, strict rejects unknown
+// service and plan keys reporting where exactly they've been found
+func parseServices(b []byte, strict bool) ([]serviceConfig, error) {
+	if !strict {
+		services := make([]serviceConfig, 0)
+		return services, json.Unmarshal(b, &services)
+	}
+
+	raw := make([]json.RawMessage, 0)
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("services: %v", err)
+	}
+
+	services := make([]serviceConfig, len(raw))
+	for i := range raw {
+		service := struct {
+			serviceConfig
+			Plans []json.RawMessage `json:"plans"`
+		}{}
+		if err := decodeStrict(raw[i], &service); err != nil {
+			return nil, fmt.Errorf("services[%d]: %v", i, err)
+		}
+
+		services[i] = service.serviceConfig
+		services[i].Plans = make([]planConfig, len(service.Plans))
+		for j := range service.Plans {
+			if err := decodeStrict(service.Plans[j], &services[i].Plans[j]); err != nil {
+				return nil, fmt.Errorf("services[%d].plans[%d]: %v", i, j, err)
+			}
+		}
+	}
+	return services, nil
+}
+
+// validate checks the configuration reporting all problems at once,
+// the services list is validated when the catalog is built
+func (c *config) validate() error {
+	errs := validationError{}
+	if c.Source == "" {
+		errs = append(errs, "source is required")
+	}
+	if c.CredentialsSecret == "" {
+		errs = append(errs, "credentials_secret is required")
+	}
+	if c.Auth.Username == "" || c.Auth.Password == "" {
+		errs = append(errs, "auth username and password are required")
+	}
+
+	names := make(map[string]bool)
+	for i, b := range c.Backends {
+		switch {
+		case b.Name == "":
+			errs = append(errs, fmt.Sprintf("backends[%d]: name is required", i))
+		case names[b.Name]:
+			errs = append(errs, fmt.Sprintf("backends[%d]: duplicate name %q", i, b.Name))
+		}
+		names[b.Name] = true
+		if b.Source == "" {
+			errs = append(errs, fmt.Sprintf("backends[%d]: source is required", i))
+		}
+	}
+	// instances created before backends existed are recorded on the default one
+	if len(c.Backends) != 0 && !names[defaultBackend] {
+		errs = append(errs, fmt.Sprintf("backends: %q is required, instances created before backends existed are placed on it", defaultBackend))
+	}
+
+	cat, err := newCatalog(c.Services, c.GUID)
+	if err != nil {
+		if v, ok := err.(validationError); ok {
+			errs = append(errs, v...)
+		} else {
+			errs = append(errs, err.Error())
+		}
+	} else {
+		errs = append(errs, cat.validatePlacement(c.backends())...)
+		errs = append(errs, cat.validateSeeds(c.seeds)...)
+		errs = append(errs, cat.validateBackups(c.BackupStore != nil, nil)...)
+	}
+	if c.BackupStore != nil {
+		errs = append(errs, c.BackupStore.validate()...)
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// backends returns the configured backends, the source
+// is the only backend when none is configured
+func (c *config) backends() []backendConfig {
+	if len(c.Backends) != 0 {
+		return c.Backends
+	}
+	return []backendConfig{{Name: defaultBackend, Source: c.Source}}
+}
+
+// decodeStrict decodes the named JSON document rejecting unknown keys
+func decodeStrict(b []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/vchrisr/cf-postgresql-broker/pgp"
+)
+
+// errInstanceNotFound is returned when an instance cannot be fetched
+var errInstanceNotFound = brokerapi.NewFailureResponseBuilder(
+	errors.New("instance cannot be fetched"), http.StatusNotFound, "instance-not-found",
+).WithEmptyResponse().Build()
+
+// apiError translates errors of the database layer to the broker API ones,
+// the platform relies on their status codes for retries and orphan mitigation
+func apiError(err error) error {
+	switch err {
+	case pgp.ErrDatabaseExists, pgp.ErrSchemaExists:
+		return brokerapi.ErrInstanceAlreadyExists
+	case pgp.ErrDatabaseNotFound, pgp.ErrSchemaNotFound:
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+	return err
+}
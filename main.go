@@ -4,9 +4,12 @@ import (
 	"encoding/json"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"code.cloudfoundry.org/lager"
 	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/auth"
 )
 
 func main() {
@@ -19,31 +22,63 @@ func main() {
 	logger := lager.NewLogger(name)
 	logger.RegisterSink(lager.NewWriterSink(os.Stdout, lager.DEBUG))
 
-	// create requests serviceBroker
-	broker, err := NewServiceBroker(
-		os.Getenv("PG_SOURCE"),
-		os.Getenv("PG_SERVICES"),
-		os.Getenv("CF_INSTANCE_GUID"))
+	// read configuration from the file when it's provided
+	path := os.Getenv("CONFIG_FILE")
+	cfg, err := readConfig(path)
+	if err != nil {
+		logger.Fatal("config", err)
+	}
 
+	// create requests serviceBroker
+	broker, err := NewServiceBroker(cfg, logger)
 	if err != nil {
 		logger.Fatal("serviceBroker", err)
 	}
 
+	if path != "" {
+		go reload(broker, path, logger)
+	}
+
 	// register service broker handler
 	http.Handle("/", brokerapi.New(broker, logger, brokerapi.BrokerCredentials{
-		Username: os.Getenv("BASIC_AUTH_USERNAME"),
-		Password: os.Getenv("BASIC_AUTH_PASSWORD"),
+		Username: cfg.Auth.Username,
+		Password: cfg.Auth.Password,
 	}))
 
+	// instance sizes and quota states for Prometheus
+	http.Handle("/metrics", auth.NewWrapper(cfg.Auth.Username, cfg.Auth.Password).WrapFunc(broker.metrics))
+
 	// boot up
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	logger.Info("boot-up", lager.Data{"port": cfg.Port})
+	if err := http.ListenAndServe(":"+cfg.Port, nil); err != nil {
+		logger.Fatal("serve", err)
 	}
+}
 
-	logger.Info("boot-up", lager.Data{"port": port})
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		logger.Fatal("serve", err)
+// readConfig reads the named configuration file or the environment variables when path is blank
+func readConfig(path string) (*config, error) {
+	if path == "" {
+		return configFromEnv()
+	}
+	return loadConfig(path)
+}
+
+// reload re-reads the named configuration file on SIGHUP replacing the broker
+// catalog, other settings take effect after a restart only
+func reload(broker *serviceBroker, path string, logger lager.Logger) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		cfg, err := loadConfig(path)
+		if err == nil {
+			err = broker.reload(cfg)
+		}
+		if err != nil {
+			logger.Error("reload", err, lager.Data{"path": path})
+			continue
+		}
+		logger.Info("reload", lager.Data{"path": path})
 	}
 }
 
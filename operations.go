@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/google/uuid"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/vchrisr/cf-postgresql-broker/pgp"
+	"github.com/vchrisr/cf-postgresql-broker/store"
+)
+
+// operation kinds, they prefix operation IDs to keep them readable in logs
+const (
+	opProvision   = "provision"
+	opUpdate      = "update"
+	opDeprovision = "deprovision"
+	opBind        = "bind"
+	opUnbind      = "unbind"
+)
+
+// retry policy of operations failing with transient errors
+const (
+	maxAttempts   = 8
+	retryDelay    = 5 * time.Second
+	maxRetryDelay = 5 * time.Minute
+)
+
+// job implements an operation kind, it's looked up by the kind of the
+// stored operation so that operations can be resumed after a restart
+type job struct {
+	// run performs the operation, it's attempted again when it fails with
+	// a transient error or gets interrupted so it has to be idempotent
+	run func(ctx context.Context, op *store.Operation) error
+
+	// abort cleans up after an operation that has failed for good, optional
+	abort func(ctx context.Context, op *store.Operation)
+}
+
+// jobs returns implementations of all operation kinds
+func (sb *serviceBroker) jobs() map[string]job {
+	return map[string]job{
+		opProvision:   {run: sb.runProvision, abort: sb.abortProvision},
+		opUpdate:      {run: sb.runUpdate},
+		opDeprovision: {run: sb.runDeprovision},
+		opBind:        {run: sb.runBind, abort: sb.abortBind},
+		opUnbind:      {run: sb.runUnbind},
+	}
+}
+
+// newOperation builds an operation of the named kind carrying the provided payload
+func newOperation(kind, instanceID, bindingID string, payload interface{}) (*store.Operation, error) {
+	op := &store.Operation{
+		ID:          kind + ":" + uuid.New().String(),
+		Kind:        kind,
+		InstanceID:  instanceID,
+		BindingID:   bindingID,
+		State:       string(brokerapi.InProgress),
+		Description: kind + " in progress",
+	}
+	if payload != nil {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		op.Payload = raw
+	}
+	return op, nil
+}
+
+// start stores a new in progress operation and executes it in the background,
+// the request context is cancelled as soon as the response is sent
+func (sb *serviceBroker) start(ctx context.Context, kind, instanceID, bindingID string, payload interface{}) (string, error) {
+	op, err := newOperation(kind, instanceID, bindingID, payload)
+	if err != nil {
+		return "", err
+	}
+	if err := sb.store.CreateOperation(ctx, op); err != nil {
+		return "", err
+	}
+
+	go sb.execute(op)
+	return op.ID, nil
+}
+
+// perform executes an operation within the request, it's attempted only
+// once because the platform retries synchronous requests on its own
+func (sb *serviceBroker) perform(ctx context.Context, kind, instanceID, bindingID string, payload interface{}) error {
+	op, err := newOperation(kind, instanceID, bindingID, payload)
+	if err != nil {
+		return err
+	}
+
+	j := sb.jobs()[kind]
+	if err := j.run(ctx, op); err != nil {
+		sb.logger.Error(kind, err, lager.Data{"instance": instanceID, "binding": bindingID})
+		if j.abort != nil {
+			j.abort(ctx, op)
+		}
+		return err
+	}
+	return nil
+}
+
+// execute runs the provided operation on its own context until it succeeds,
+// fails with a permanent error or runs out of attempts, the outcome and every
+// failed attempt are recorded so that a restarted broker carries on
+func (sb *serviceBroker) execute(op *store.Operation) {
+	ctx := context.Background()
+	logger := sb.logger.Session("execute", lager.Data{"operation": op.ID})
+
+	j, ok := sb.jobs()[op.Kind]
+	if !ok {
+		sb.finish(ctx, op, brokerapi.Failed, fmt.Sprintf("unknown operation kind %q", op.Kind))
+		return
+	}
+
+	for {
+		time.Sleep(time.Until(op.RunAt))
+
+		err := j.run(ctx, op)
+		if err == nil {
+			sb.finish(ctx, op, brokerapi.Succeeded, op.Kind+" succeeded")
+			return
+		}
+
+		op.Attempts++
+		logger.Error("attempt-failed", err, lager.Data{"attempts": op.Attempts})
+
+		if !pgp.Transient(err) || op.Attempts >= maxAttempts {
+			if j.abort != nil {
+				j.abort(ctx, op)
+			}
+
+			description := fmt.Sprintf("%s failed: %v", op.Kind, err)
+			if op.Attempts > 1 {
+				description = fmt.Sprintf("%s failed after %d attempts: %v", op.Kind, op.Attempts, err)
+			}
+			sb.finish(ctx, op, brokerapi.Failed, description)
+			return
+		}
+
+		op.RunAt = time.Now().Add(backoff(op.Attempts))
+		description := fmt.Sprintf("%s in progress, attempt %d failed and will be retried: %v", op.Kind, op.Attempts, err)
+		if err := sb.store.RetryOperation(ctx, op.ID, op.Attempts, op.RunAt, description); err != nil {
+			logger.Error("retry-operation", err)
+		}
+	}
+}
+
+// progress describes the current step of the provided operation in
+// last_operation, it's best-effort and no-op for synchronous operations
+func (sb *serviceBroker) progress(ctx context.Context, op *store.Operation, description string) {
+	err := sb.store.UpdateOperation(ctx, op.ID, string(brokerapi.InProgress), description)
+	if err != nil && err != store.ErrNotFound {
+		sb.logger.Error("progress", err, lager.Data{"operation": op.ID})
+	}
+}
+
+// finish records the final state of the provided operation, an operation
+// that cannot be recorded is executed again after a restart
+func (sb *serviceBroker) finish(ctx context.Context, op *store.Operation, state brokerapi.LastOperationState, description string) {
+	if err := sb.store.UpdateOperation(ctx, op.ID, string(state), description); err != nil {
+		sb.logger.Error("update-operation", err, lager.Data{"operation": op.ID})
+	}
+}
+
+// backoff returns the delay before the next attempt of an operation
+// that has failed the provided number of times
+func backoff(attempts int) time.Duration {
+	d := retryDelay
+	for i := 1; i < attempts && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	return d
+}
+
+// inProgress returns the operation in progress on the named instance,
+// or on the named binding when bindingID isn't blank, if there's any
+func (sb *serviceBroker) inProgress(ctx context.Context, instanceID, bindingID string) (*store.Operation, error) {
+	op, err := sb.store.LatestOperation(ctx, instanceID, bindingID)
+	if err == store.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if op.State != string(brokerapi.InProgress) {
+		return nil, nil
+	}
+	return op, nil
+}
+
+// bindingsInProgress checks whether an operation is in progress on any binding of the named instance
+func (sb *serviceBroker) bindingsInProgress(ctx context.Context, instanceID string) (bool, error) {
+	ops, err := sb.store.BindingOperations(ctx, instanceID, string(brokerapi.InProgress))
+	return len(ops) != 0, err
+}
+
+// lastOperation reports state of the named operation performed on the named
+// instance, or of the latest one when platforms poll without the operation
+func (sb *serviceBroker) lastOperation(ctx context.Context, instanceID, bindingID, id string) (brokerapi.LastOperation, error) {
+	var op *store.Operation
+	var err error
+	if id == "" {
+		op, err = sb.store.LatestOperation(ctx, instanceID, bindingID)
+	} else {
+		op, err = sb.store.Operation(ctx, id)
+	}
+	if err == store.ErrNotFound || err == nil && (op.InstanceID != instanceID || op.BindingID != bindingID) {
+		return brokerapi.LastOperation{}, brokerapi.NewFailureResponse(
+			errors.New("operation not found"), http.StatusNotFound, "operation-not-found")
+	}
+	if err != nil {
+		return brokerapi.LastOperation{}, err
+	}
+
+	return brokerapi.LastOperation{
+		State:       brokerapi.LastOperationState(op.State),
+		Description: op.Description,
+	}, nil
+}
+
+// reconcile settles the state left over by a previous broker process, the
+// broker is expected to run as a single instance so every operation that
+// is still in progress has been interrupted and is resumed
+func (sb *serviceBroker) reconcile(ctx context.Context) error {
+	ops, err := sb.store.Operations(ctx, string(brokerapi.InProgress))
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		sb.logger.Info("resume-operation", lager.Data{"operation": op.ID, "attempts": op.Attempts})
+		go sb.execute(op)
+	}
+
+	instances, err := sb.store.Instances(ctx)
+	if err != nil {
+		return err
+	}
+	for _, i := range instances {
+		conn, err := sb.backendOf(i)
+		if err != nil {
+			sb.logger.Error("unknown-backend", err, lager.Data{"instance": i.ID, "backend": i.Backend})
+			continue
+		}
+
+		exists := conn.InstanceExists(ctx, i.ID)
+		if i.SharedDatabase != "" {
+			if exists, err = conn.SchemaExists(ctx, i.SharedDatabase, i.ID); err != nil {
+				return err
+			}
+		}
+		if !exists {
+			sb.logger.Info("missing-database", lager.Data{"instance": i.ID, "plan": i.PlanID})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/vchrisr/cf-postgresql-broker/pgp"
+)
+
+// schemaVersion is the JSON schema draft the parameters schemas follow
+const schemaVersion = "http://json-schema.org/draft-04/schema#"
+
+// planSchemas builds schemas of parameters accepted by a plan with the provided settings
+func planSchemas(s planSettings) *brokerapi.ServiceSchemas {
+	return &brokerapi.ServiceSchemas{
+		Instance: brokerapi.ServiceInstanceSchema{
+			Create: brokerapi.Schema{Parameters: instanceSchema(s, true)},
+			Update: brokerapi.Schema{Parameters: instanceSchema(s, false)},
+		},
+		Binding: brokerapi.ServiceBindingSchema{
+			Create: brokerapi.Schema{Parameters: bindingSchema(s)},
+		},
+	}
+}
+
+// statusParam is the key instance details report the state of the instance
+// under next to the parameters, instance schemas never offer it
+const statusParam = "status"
+
+// instanceSchema builds the schema of provision parameters,
+// or of update parameters when create is false
+func instanceSchema(s planSettings, create bool) map[string]interface{} {
+	properties := map[string]interface{}{}
+
+	// databases cannot be recreated with other options
+	if create && s.sharedDatabase() == "" {
+		for name, description := range map[string]string{
+			"encoding":   "Character set encoding of the database, e.g. UTF8",
+			"lc_collate": "String sort order of the database, e.g. de_DE.utf8",
+			"lc_ctype":   "Character classification of the database, e.g. de_DE.utf8",
+			"icu_locale": "ICU locale of the database, e.g. de-DE, the ICU locale provider is used when set",
+			"template":   "Template database the database is copied from",
+		} {
+			properties[name] = map[string]interface{}{
+				"type":        "string",
+				"minLength":   1,
+				"maxLength":   63,
+				"description": description,
+			}
+		}
+		properties["clone_from"] = map[string]interface{}{
+			"type":        "string",
+			"minLength":   1,
+			"description": "GUID of an instance of the same space the database is copied from",
+		}
+		properties["masking"] = map[string]interface{}{
+			"type":        "array",
+			"items":       maskRuleSchema(),
+			"description": "Rules columns of the copy are scrubbed with on top of the operator policy, clone_from is required",
+		}
+		if len(s.Seeds) != 0 {
+			properties["seed"] = map[string]interface{}{
+				"type":        "string",
+				"enum":        s.Seeds,
+				"description": "SQL script the database is seeded with",
+			}
+		}
+	}
+	// updates may clear extensions and settings the plan doesn't offer,
+	// e.g. those kept from a previous plan
+	if (len(s.Extensions) != 0 || !create) && s.sharedDatabase() == "" {
+		description := "Extensions installed in the database"
+		if !create {
+			description += ", extensions left out are dropped"
+		}
+		properties["extensions"] = map[string]interface{}{
+			"type":        "array",
+			"items":       map[string]interface{}{"type": "string", "enum": s.Extensions},
+			"uniqueItems": true,
+			"description": description,
+		}
+		if len(s.Extensions) == 0 {
+			properties["extensions"] = map[string]interface{}{
+				"type":        "array",
+				"maxItems":    0,
+				"description": description,
+			}
+		}
+	}
+	if len(s.AllowedSettings) != 0 || !create {
+		settings := map[string]interface{}{}
+		for name, rule := range s.AllowedSettings {
+			settings[name] = rule.schema()
+		}
+		description := "Runtime settings of the database"
+		if !create {
+			description += ", settings left out are reset to the defaults"
+		}
+		properties["settings"] = objectSchema(settings)
+		properties["settings"].(map[string]interface{})["description"] = description
+	}
+	return objectSchema(properties)
+}
+
+// bindingSchema builds the schema of bind parameters
+func bindingSchema(s planSettings) map[string]interface{} {
+	connectionLimit := map[string]interface{}{
+		"type":        "integer",
+		"minimum":     1,
+		"description": "Maximum number of concurrent connections of the binding, the plan limit when omitted",
+	}
+	if max := s.maxBindingConnections(); max != -1 {
+		connectionLimit["maximum"] = max
+	}
+
+	return objectSchema(map[string]interface{}{
+		"role": map[string]interface{}{
+			"type":        "string",
+			"enum":        []string{string(pgp.RoleReadOnly), string(pgp.RoleReadWrite), string(pgp.RoleOwner)},
+			"description": "Access level of the binding, owner when omitted",
+		},
+		"connection_limit": connectionLimit,
+	})
+}
+
+// instanceParams are parameters accepted by provision and update
+type instanceParams struct {
+	Settings   map[string]interface{} `json:"settings"`
+	Extensions []string               `json:"extensions"`
+
+	// Encoding, LCCollate, LCCtype, ICULocale and Template override
+	// the plan ones, they're accepted by provision only
+	Encoding  string `json:"encoding"`
+	LCCollate string `json:"lc_collate"`
+	LCCtype   string `json:"lc_ctype"`
+	ICULocale string `json:"icu_locale"`
+	Template  string `json:"template"`
+
+	// Seed overrides the plan seed, it's accepted by provision only
+	Seed string `json:"seed"`
+
+	// CloneFrom names the instance the database is copied from, it's accepted by provision only
+	CloneFrom string `json:"clone_from"`
+
+	// Masking scrubs columns of the copy after the operator policy, it requires CloneFrom
+	Masking []maskRule `json:"masking"`
+}
+
+// maskRule scrubs a column of a cloned database
+type maskRule struct {
+	Schema string      `json:"schema"`
+	Table  string      `json:"table"`
+	Column string      `json:"column"`
+	Rule   pgp.Masking `json:"rule"`
+
+	// Length is the number of characters truncate keeps
+	Length *int `json:"length"`
+}
+
+// maskRuleSchema builds the schema of a masking rule
+func maskRuleSchema() map[string]interface{} {
+	name := func(description string) map[string]interface{} {
+		return map[string]interface{}{"type": "string", "minLength": 1, "maxLength": 63, "description": description}
+	}
+	schema := objectSchema(map[string]interface{}{
+		"schema": name("Schema of the table, public when omitted"),
+		"table":  name("Table of the column"),
+		"column": name("Column to scrub"),
+		"rule": map[string]interface{}{
+			"type":        "string",
+			"enum":        []string{string(pgp.MaskHash), string(pgp.MaskNullify), string(pgp.MaskFakeEmail), string(pgp.MaskTruncate)},
+			"description": "How values are scrubbed",
+		},
+		"length": map[string]interface{}{
+			"type":        "integer",
+			"minimum":     0,
+			"description": "Number of characters truncate keeps, required by truncate",
+		},
+	})
+	schema["required"] = []string{"table", "column", "rule"}
+	return schema
+}
+
+// validateMaskRules checks lengths of the provided rules the schema cannot
+// tell apart, prefix locates the rules in messages
+func validateMaskRules(rules []maskRule, prefix string) []string {
+	errs := make([]string, 0)
+	for i, r := range rules {
+		switch {
+		case r.Rule == pgp.MaskTruncate && r.Length == nil:
+			errs = append(errs, fmt.Sprintf("%s[%d]: length is required by truncate", prefix, i))
+		case r.Rule != pgp.MaskTruncate && r.Length != nil:
+			errs = append(errs, fmt.Sprintf("%s[%d]: length only applies to truncate", prefix, i))
+		}
+	}
+	return errs
+}
+
+// maskRules converts the provided rules to the database layer ones,
+// optional ones are skipped for columns the database doesn't have
+func maskRules(rules []maskRule, optional bool) []pgp.MaskRule {
+	converted := make([]pgp.MaskRule, len(rules))
+	for i, r := range rules {
+		converted[i] = pgp.MaskRule{Schema: r.Schema, Table: r.Table, Column: r.Column, Masking: r.Rule, Optional: optional}
+		if converted[i].Schema == "" {
+			converted[i].Schema = "public"
+		}
+		if r.Length != nil {
+			converted[i].Length = *r.Length
+		}
+	}
+	return converted
+}
+
+// decodeInstanceParams decodes the named provision or update parameters,
+// parameters are expected to be validated against the instance schema
+func decodeInstanceParams(raw json.RawMessage) (*instanceParams, error) {
+	p := &instanceParams{}
+	if len(raw) != 0 {
+		if err := json.Unmarshal(raw, p); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// settings converts values of the runtime settings to their textual form
+func (p *instanceParams) settings() map[string]string {
+	settings := make(map[string]string, len(p.Settings))
+	for name, v := range p.Settings {
+		switch v := v.(type) {
+		case bool:
+			settings[name] = "off"
+			if v {
+				settings[name] = "on"
+			}
+		case float64:
+			settings[name] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			settings[name] = fmt.Sprint(v)
+		}
+	}
+	return settings
+}
+
+// mergeParams overlays top-level keys of the named update parameters
+// over the named current ones, keys left out keep their values
+func mergeParams(current, update json.RawMessage) (json.RawMessage, error) {
+	if len(update) == 0 {
+		return current, nil
+	}
+
+	merged := make(map[string]json.RawMessage)
+	for _, raw := range []json.RawMessage{current, update} {
+		if len(raw) == 0 {
+			continue
+		}
+		params := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, err
+		}
+		for k, v := range params {
+			merged[k] = v
+		}
+	}
+	return json.Marshal(merged)
+}
+
+// adaptParams adapts the named merged parameters of an update to a plan with
+// the provided settings, settings the plan doesn't accept are left out so that
+// they're reset while extensions it doesn't allow conflict with the plan
+func adaptParams(s planSettings, raw json.RawMessage) (json.RawMessage, error) {
+	if len(raw) == 0 {
+		return raw, nil
+	}
+	params := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, err
+	}
+
+	if len(params["extensions"]) != 0 {
+		var extensions []string
+		if err := json.Unmarshal(params["extensions"], &extensions); err != nil {
+			return nil, err
+		}
+		// extensions installed along with them or by other means aren't managed
+		if name, ok := s.disallowedExtension(extensions); ok {
+			return nil, brokerapi.ErrPlanChangeNotSupported.AppendErrorMessage(
+				fmt.Sprintf("extension %q of the parameters is not allowed by the target plan, update extensions to leave it out", name))
+		}
+	}
+
+	if len(params["settings"]) != 0 {
+		settings := make(map[string]interface{})
+		if err := json.Unmarshal(params["settings"], &settings); err != nil {
+			return nil, err
+		}
+		for name, value := range settings {
+			rule, ok := s.AllowedSettings[name]
+			if !ok || len(validateSchema(rule.schema(), value, name)) != 0 {
+				delete(settings, name)
+			}
+		}
+		adapted, err := json.Marshal(settings)
+		if err != nil {
+			return nil, err
+		}
+		params["settings"] = adapted
+	}
+	return json.Marshal(params)
+}
+
+// bindParams are parameters accepted by bind
+type bindParams struct {
+	Role            pgp.Role `json:"role"`
+	ConnectionLimit *int     `json:"connection_limit"`
+}
+
+// decodeBindParams decodes the named bind parameters filling in defaults,
+// parameters are expected to be validated against the binding schema
+func decodeBindParams(raw json.RawMessage) (*bindParams, error) {
+	p := &bindParams{}
+	if len(raw) != 0 {
+		if err := json.Unmarshal(raw, p); err != nil {
+			return nil, err
+		}
+	}
+	if p.Role == "" {
+		p.Role = pgp.RoleOwner
+	}
+	return p, nil
+}
+
+// objectSchema builds the schema of an object that
+// doesn't accept properties other than the provided ones
+func objectSchema(properties map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"$schema":              schemaVersion,
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// validateParams validates the named raw parameters against the provided schema
+func validateParams(schema brokerapi.Schema, raw json.RawMessage) error {
+	if len(raw) == 0 {
+		raw = json.RawMessage("{}")
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return brokerapi.ErrRawParamsInvalid
+	}
+
+	if errs := validateSchema(schema.Parameters, v, "parameters"); len(errs) != 0 {
+		return brokerapi.NewFailureResponse(
+			errors.New("invalid parameters: "+strings.Join(errs, "; ")),
+			http.StatusBadRequest, "invalid-parameters")
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package pgp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// DumpCommand is the pg_dump binary Dump runs, it has to be
+// of the same or a newer major version than the servers
+var DumpCommand = "pg_dump"
+
+// Dump writes a logical backup of the named database in the pg_dump custom
+// format to w, it doesn't carry owners nor privileges so that it can be
+// restored into any instance
+func (b *PGP) Dump(ctx context.Context, d string, w io.Writer) error {
+	// the password is kept out of the process list
+	source := b.source
+	source.Path = b.dbname(d)
+	source.RawQuery = ""
+	password, _ := source.User.Password()
+	source.User = nil
+
+	cmd := exec.CommandContext(ctx, DumpCommand,
+		"--format=custom", "--no-owner", "--no-privileges",
+		"--username="+b.source.User.Username(),
+		"--dbname="+source.String())
+	cmd.Env = append(append(os.Environ(), "PGPASSWORD="+password), dumpEnv(b.source.Query())...)
+	cmd.Stdout = w
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pg_dump: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// libpqEnv are the environment variables libpq reads the connection parameters of
+// the source URL from, the driver sends parameters it doesn't know as run-time settings
+var libpqEnv = map[string]string{
+	"sslmode":          "PGSSLMODE",
+	"sslcert":          "PGSSLCERT",
+	"sslkey":           "PGSSLKEY",
+	"sslrootcert":      "PGSSLROOTCERT",
+	"connect_timeout":  "PGCONNECT_TIMEOUT",
+	"application_name": "PGAPPNAME",
+	"client_encoding":  "PGCLIENTENCODING",
+	"datestyle":        "PGDATESTYLE",
+	"timezone":         "PGTZ",
+	"geqo":             "PGGEQO",
+	"options":          "PGOPTIONS",
+}
+
+// driverParameters are parameters of the source URL only the driver uses
+var driverParameters = map[string]bool{
+	"host":                           true,
+	"port":                           true,
+	"user":                           true,
+	"password":                       true,
+	"dbname":                         true,
+	"fallback_application_name":      true,
+	"binary_parameters":              true,
+	"disable_prepared_binary_result": true,
+}
+
+// dumpEnv returns the environment pg_dump connects with the provided parameters
+// of the source URL the same way the driver does, it requires SSL by default
+// and other run-time settings are passed as options
+func dumpEnv(query url.Values) []string {
+	if query.Get("sslmode") == "" {
+		query.Set("sslmode", "require")
+	}
+
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	env := make([]string, 0, len(names))
+	options := make([]string, 0)
+	if query.Get("options") != "" {
+		options = append(options, query.Get("options"))
+	}
+	for _, name := range names {
+		value := query.Get(name)
+		switch {
+		case name == "options", driverParameters[name]:
+		case libpqEnv[name] != "":
+			env = append(env, libpqEnv[name]+"="+value)
+		default:
+			options = append(options, "-c "+escapeOption(name+"="+value))
+		}
+	}
+	if len(options) != 0 {
+		env = append(env, "PGOPTIONS="+strings.Join(options, " "))
+	}
+	return env
+}
+
+// escapeOption escapes spaces and backslashes of the named option the way
+// PGOPTIONS expects it
+func escapeOption(s string) string {
+	return strings.NewReplacer(`\`, `\\`, " ", `\ `).Replace(s)
+}
@@ -0,0 +1,204 @@
+package pgp
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+)
+
+// Masking is the way a column of a copied database is scrubbed
+type Masking string
+
+// maskings columns can be scrubbed with
+const (
+	// MaskHash replaces values with salted hashes, equal values stay equal within the database
+	MaskHash Masking = "hash"
+	// MaskNullify replaces values with NULL
+	MaskNullify Masking = "nullify"
+	// MaskFakeEmail replaces values with made up addresses derived from salted hashes
+	MaskFakeEmail Masking = "fake_email"
+	// MaskTruncate keeps the first Length characters of values
+	MaskTruncate Masking = "truncate"
+)
+
+// MaskRule scrubs a column of a database
+type MaskRule struct {
+	Schema  string
+	Table   string
+	Column  string
+	Masking Masking
+
+	// Length is the number of characters truncate keeps
+	Length int
+
+	// Optional rules are skipped when the column doesn't exist
+	Optional bool
+}
+
+// String implements fmt.Stringer
+func (r MaskRule) String() string {
+	return r.Schema + "." + r.Table + "." + r.Column
+}
+
+// MaskDB scrubs columns of the named database with the provided rules in a single
+// transaction, statistics and materialized views are refreshed so that they don't
+// keep the original values, user triggers don't fire on the changes
+func (b *PGP) MaskDB(ctx context.Context, d string, rules []MaskRule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	// the salt makes hashes of guessable values irreversible
+	salt, err := b.password(16)
+	if err != nil {
+		return err
+	}
+
+	conn, err := b.open(b.dbname(d))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "SET LOCAL ROLE "+de(b.groupRole(d, RoleOwner))); err != nil {
+		return err
+	}
+
+	masked := make(map[string]bool)
+	tables := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		var typ, category string
+		err := tx.QueryRowContext(ctx, `SELECT format_type(a.atttypid, a.atttypmod), t.typcategory
+			FROM pg_attribute a
+			JOIN pg_class c ON c.oid = a.attrelid
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			JOIN pg_type t ON t.oid = a.atttypid
+			WHERE n.nspname = $1 AND c.relname = $2 AND a.attname = $3
+			AND c.relkind IN ('r', 'p') AND a.attnum > 0 AND NOT a.attisdropped`,
+			rule.Schema, rule.Table, rule.Column).Scan(&typ, &category)
+		if err == sql.ErrNoRows && rule.Optional {
+			continue
+		}
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("column %s doesn't exist", rule)
+		}
+		if err != nil {
+			return err
+		}
+
+		// casts to the column type cut values to its length
+		column := de(rule.Column)
+		var value string
+		switch rule.Masking {
+		case MaskNullify:
+			value = "NULL"
+		case MaskHash:
+			value = "md5(" + se(salt) + " || " + column + ")::" + typ
+		case MaskFakeEmail:
+			value = "('user-' || left(md5(" + se(salt) + " || " + column + "), 16) || '@example.invalid')::" + typ
+		case MaskTruncate:
+			value = "left(" + column + ", " + strconv.Itoa(rule.Length) + ")::" + typ
+		default:
+			return fmt.Errorf("unknown masking %q", rule.Masking)
+		}
+		if rule.Masking != MaskNullify && category != "S" {
+			return fmt.Errorf("column %s is not a string column, it can only be nullified", rule)
+		}
+
+		table := de(rule.Schema) + "." + de(rule.Table)
+		triggers, err := userTriggers(ctx, tx, table)
+		if err != nil {
+			return err
+		}
+		for name := range triggers {
+			if _, err := tx.ExecContext(ctx, "ALTER TABLE "+table+" DISABLE TRIGGER "+de(name)); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE "+table+" SET "+column+" = "+value+" WHERE "+column+" IS NOT NULL"); err != nil {
+			return fmt.Errorf("masking column %s: %v", rule, err)
+		}
+		for name, enabled := range triggers {
+			mode := ""
+			if enabled == "A" {
+				mode = " ALWAYS"
+			}
+			if _, err := tx.ExecContext(ctx, "ALTER TABLE "+table+" ENABLE"+mode+" TRIGGER "+de(name)); err != nil {
+				return err
+			}
+		}
+
+		if !masked[table] {
+			masked[table] = true
+			tables = append(tables, table)
+		}
+	}
+
+	// column statistics keep samples of the most common values
+	for _, table := range tables {
+		if _, err := tx.ExecContext(ctx, "ANALYZE "+table); err != nil {
+			return err
+		}
+	}
+
+	views, err := materializedViews(ctx, tx)
+	if err != nil {
+		return err
+	}
+	for _, view := range views {
+		if _, err := tx.ExecContext(ctx, "REFRESH MATERIALIZED VIEW "+view); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// userTriggers returns states of the user triggers of the named
+// table that fire on changes by the broker, keyed by their names
+func userTriggers(ctx context.Context, q querier, table string) (map[string]string, error) {
+	rows, err := q.QueryContext(ctx, `SELECT tgname, tgenabled FROM pg_trigger
+		WHERE tgrelid = $1::regclass AND NOT tgisinternal AND tgenabled IN ('O', 'A')`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	triggers := make(map[string]string)
+	for rows.Next() {
+		var name, enabled string
+		if err := rows.Scan(&name, &enabled); err != nil {
+			return nil, err
+		}
+		triggers[name] = enabled
+	}
+	return triggers, rows.Err()
+}
+
+// materializedViews returns qualified names of the populated materialized views
+// in creation order, views are created after the ones they depend on
+func materializedViews(ctx context.Context, q querier) ([]string, error) {
+	rows, err := q.QueryContext(ctx, `SELECT n.nspname, c.relname FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind = 'm' AND c.relispopulated ORDER BY c.oid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	views := make([]string, 0)
+	for rows.Next() {
+		var schema, name string
+		if err := rows.Scan(&schema, &name); err != nil {
+			return nil, err
+		}
+		views = append(views, de(schema)+"."+de(name))
+	}
+	return views, rows.Err()
+}
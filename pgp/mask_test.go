@@ -0,0 +1,92 @@
+package pgp
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestMaskDB(t *testing.T) {
+	pgp, err := newPGP(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if _, err := pgp.CreateDB(ctx, testDB, DBOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	defer pgp.DropDB(ctx, testDB)
+
+	if err := pgp.Seed(ctx, testDB, `CREATE TABLE users (email varchar(20), name text, phone text, age int);
+		INSERT INTO users VALUES ('jane@example.com', 'Jane Doe', '555-1234', 42);
+		CREATE TABLE audit (email text);
+		CREATE FUNCTION audit() RETURNS trigger LANGUAGE plpgsql AS $$
+		BEGIN INSERT INTO audit VALUES (OLD.email); RETURN NEW; END $$;
+		CREATE TRIGGER audit AFTER UPDATE ON users FOR EACH ROW EXECUTE PROCEDURE audit();
+		CREATE MATERIALIZED VIEW names AS SELECT name FROM users;
+		CREATE TABLE "x""; RESET ROLE; --" ("y""; RESET ROLE; --" text);
+		INSERT INTO "x""; RESET ROLE; --" VALUES ('secret')`); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rules := range [][]MaskRule{
+		{{Schema: "public", Table: "users", Column: "missing", Masking: MaskNullify}},
+		{{Schema: "public", Table: "users", Column: "age", Masking: MaskHash}},
+	} {
+		if err := pgp.MaskDB(ctx, testDB, rules); err == nil {
+			t.Fatalf("%v: masking has succeeded", rules)
+		}
+	}
+
+	err = pgp.MaskDB(ctx, testDB, []MaskRule{
+		{Schema: "public", Table: "customers", Column: "email", Masking: MaskHash, Optional: true},
+		{Schema: "public", Table: "users", Column: "email", Masking: MaskFakeEmail},
+		{Schema: "public", Table: "users", Column: "name", Masking: MaskTruncate, Length: 1},
+		{Schema: "public", Table: "users", Column: "phone", Masking: MaskHash},
+		{Schema: "public", Table: "users", Column: "age", Masking: MaskNullify},
+		{Schema: "public", Table: `x"; RESET ROLE; --`, Column: `y"; RESET ROLE; --`, Masking: MaskHash},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := pgp.open(pgp.dbname(testDB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var email, name, phone, view string
+	var age *int
+	if err := conn.QueryRow("SELECT email, name, phone, age, (SELECT name FROM names) FROM users").Scan(&email, &name, &phone, &age, &view); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(email, "user-") || len(email) != 20 || name != "J" || len(phone) != 32 || age != nil || view != "J" {
+		t.Fatalf("row = %q, %q, %q, %v, view = %q", email, name, phone, age, view)
+	}
+
+	// quotes in identifiers don't end them
+	var quoted string
+	if err := conn.QueryRow(`SELECT "y""; RESET ROLE; --" FROM "x""; RESET ROLE; --"`).Scan(&quoted); err != nil {
+		t.Fatal(err)
+	}
+	if quoted == "secret" || len(quoted) != 32 {
+		t.Fatalf("quoted column = %q", quoted)
+	}
+
+	// triggers don't see the original values
+	var n int
+	if err := conn.QueryRow("SELECT count(*) FROM audit").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("audit rows = %d, want 0", n)
+	}
+	if err := conn.QueryRow("SELECT count(*) FROM pg_trigger WHERE tgname = 'audit' AND tgenabled = 'O'").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatal("trigger hasn't been enabled again")
+	}
+}
@@ -4,15 +4,32 @@ import (
 	"context"
 	"crypto/rand"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/url"
 	"strings"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
+var (
+	// ErrDatabaseExists is returned when the database to create already exists
+	ErrDatabaseExists = errors.New("database already exists")
+
+	// ErrDatabaseNotFound is returned when the named database doesn't exist
+	ErrDatabaseNotFound = errors.New("database doesn't exist")
+)
+
+// seededComment marks databases a seed script has run in
+const seededComment = "seeded by the service broker"
+
+// readOnlySetting is how a read-only default appears in pg_db_role_setting
+const readOnlySetting = "default_transaction_read_only=on"
+
 // PGP is a postgresql manipulation entity implementation
 type PGP struct {
 	source url.URL
@@ -28,6 +45,67 @@ type Credentials struct {
 	Host     string `json:"host"`
 	Port     string `json:"port"`
 	Url      string `json:"url"`
+	// Schema is the schema of instances sharing a database, the user's search_path is set to it
+	Schema string `json:"schema,omitempty"`
+	// ConnectionLimit is the maximum number of concurrent connections of the user, blank is unlimited
+	ConnectionLimit *int `json:"connection_limit,omitempty"`
+	// DatabaseConnectionLimit is the maximum number of concurrent connections
+	// to the database shared by all users, blank is unlimited
+	DatabaseConnectionLimit *int `json:"database_connection_limit,omitempty"`
+}
+
+// DBOptions are options a database is created with
+type DBOptions struct {
+	// Encoding, LCCollate and LCCtype of the database, blank inherit the template ones
+	Encoding  string
+	LCCollate string
+	LCCtype   string
+	// ICULocale makes the database use the ICU locale provider with the named locale
+	ICULocale string
+	// Template is the database to copy, template0 is used by default
+	// when encoding or locale differ from the server defaults
+	Template string
+}
+
+// Extension is an extension installed in a database
+type Extension struct {
+	Name    string
+	Version string
+}
+
+// UnsupportedError is returned when the server doesn't support a database option
+type UnsupportedError string
+
+// Error implements error
+func (e UnsupportedError) Error() string {
+	return string(e)
+}
+
+// DBSettings are settings applied to a database with ALTER DATABASE
+type DBSettings struct {
+	// ConnectionLimit is the maximum number of concurrent connections, -1 is unlimited
+	ConnectionLimit int
+	// StatementTimeout is the default statement_timeout, blank resets it to the server default
+	StatementTimeout string
+}
+
+// Role is the access level of a user on a database
+type Role string
+
+// roles users can be created with
+const (
+	// RoleOwner acts as the instance owner role, it can create, alter and drop objects
+	RoleOwner Role = "owner"
+	// RoleReadWrite can read and modify data of all tables
+	RoleReadWrite Role = "readwrite"
+	// RoleReadOnly can only read data of all tables
+	RoleReadOnly Role = "readonly"
+)
+
+// groupPrivileges are privileges on tables and sequences granted to group roles
+var groupPrivileges = map[Role]struct{ tables, sequences string }{
+	RoleReadWrite: {"SELECT, INSERT, UPDATE, DELETE, TRUNCATE, REFERENCES, TRIGGER", "USAGE, SELECT, UPDATE"},
+	RoleReadOnly:  {"SELECT", "SELECT"},
 }
 
 // defaultPort is PostgreSQL default port
@@ -64,56 +142,653 @@ func New(source string) (*PGP, error) {
 	}, nil
 }
 
-// CreateDB creates the named database
-func (b *PGP) CreateDB(ctx context.Context, d string) (string, error) {
+// CreateDB creates the named database owned by the instance owner role
+func (b *PGP) CreateDB(ctx context.Context, d string, opts DBOptions) (string, error) {
+	dbname := b.dbname(d)
+	owner, err := b.createOwner(ctx, d)
+	if err != nil {
+		return dbname, err
+	}
+	query := "CREATE DATABASE " + de(dbname) + " OWNER " + de(owner)
+
+	template := opts.Template
+	if template == "" && (opts.Encoding != "" || opts.LCCollate != "" || opts.LCCtype != "" || opts.ICULocale != "") {
+		template = "template0"
+	}
+	if template != "" {
+		query += " TEMPLATE " + de(template)
+	}
+	if opts.Encoding != "" {
+		query += " ENCODING " + se(opts.Encoding)
+	}
+	if opts.LCCollate != "" {
+		query += " LC_COLLATE " + se(opts.LCCollate)
+	}
+	if opts.LCCtype != "" {
+		query += " LC_CTYPE " + se(opts.LCCtype)
+	}
+	if opts.ICULocale != "" {
+		query += " LOCALE_PROVIDER icu ICU_LOCALE " + se(opts.ICULocale)
+	}
+
+	_, err = b.conn.ExecContext(ctx, query)
+	if code(err) == "42P04" {
+		return dbname, ErrDatabaseExists
+	}
+	if err != nil {
+		return dbname, err
+	}
+
+	conn, err := b.open(dbname)
+	if err != nil {
+		return dbname, err
+	}
+	defer conn.Close()
+	return dbname, restrictPublic(ctx, conn, dbname, owner)
+}
+
+// restrictPublic keeps roles other than the named owner role from creating
+// objects in the named dedicated database the provided connection is connected
+// to, all databases let everyone create temporary tables and PostgreSQL 14
+// and older let everyone create in the public schema
+func restrictPublic(ctx context.Context, conn *sql.DB, dbname, owner string) error {
+	statements := []string{"REVOKE TEMPORARY ON DATABASE " + de(dbname) + " FROM PUBLIC"}
+
+	var public bool
+	if err := conn.QueryRowContext(ctx, "SELECT EXISTS (SELECT FROM pg_namespace WHERE nspname = 'public')").Scan(&public); err != nil {
+		return err
+	}
+	if public {
+		statements = append(statements,
+			"REVOKE CREATE ON SCHEMA public FROM PUBLIC",
+			"GRANT USAGE, CREATE ON SCHEMA public TO "+de(owner),
+		)
+	}
+	for _, statement := range statements {
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateDBOptions checks that the server supports the provided database
+// options, unsupported ones are reported with UnsupportedError
+func (b *PGP) ValidateDBOptions(ctx context.Context, opts DBOptions) error {
+	if opts.Encoding != "" {
+		var id int
+		if err := b.conn.QueryRowContext(ctx, "SELECT pg_char_to_encoding($1)", opts.Encoding).Scan(&id); err != nil {
+			return err
+		}
+		if id < 0 {
+			return UnsupportedError(fmt.Sprintf("encoding %q is not supported", opts.Encoding))
+		}
+	}
+
+	// locales are known from the collations imported from the operating system
+	for _, locale := range []string{opts.LCCollate, opts.LCCtype} {
+		if locale == "" {
+			continue
+		}
+		var exists bool
+		if err := b.conn.QueryRowContext(ctx, `SELECT $1 IN ('C', 'POSIX')
+			OR EXISTS (SELECT FROM pg_collation WHERE collprovider = 'c' AND collcollate = $1)
+			OR EXISTS (SELECT FROM pg_database WHERE datcollate = $1 OR datctype = $1)`, locale).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return UnsupportedError(fmt.Sprintf("locale %q is not supported", locale))
+		}
+	}
+
+	if opts.ICULocale != "" {
+		var version int
+		if err := b.conn.QueryRowContext(ctx, "SELECT current_setting('server_version_num')::int").Scan(&version); err != nil {
+			return err
+		}
+		if version < 150000 {
+			return UnsupportedError("ICU locales require PostgreSQL 15 or later")
+		}
+
+		var exists bool
+		if err := b.conn.QueryRowContext(ctx, `SELECT EXISTS (SELECT FROM pg_collation
+			WHERE collprovider = 'i' AND collname IN ($1, $1 || '-x-icu'))`, opts.ICULocale).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return UnsupportedError(fmt.Sprintf("ICU locale %q is not supported", opts.ICULocale))
+		}
+	}
+
+	// only databases marked as templates can be copied
+	if opts.Template != "" {
+		var exists bool
+		if err := b.conn.QueryRowContext(ctx, "SELECT EXISTS (SELECT FROM pg_database WHERE datname = $1 AND datistemplate)", opts.Template).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return UnsupportedError(fmt.Sprintf("template %q doesn't exist", opts.Template))
+		}
+	}
+	return nil
+}
+
+// CloneDB creates the named database as a copy of the database of the named
+// source instance, connections to the source are blocked and terminated while
+// it's copied. Objects of the copy are handed over to its own owner role and
+// privileges of the source roles on them are revoked.
+func (b *PGP) CloneDB(ctx context.Context, d, source string) (string, error) {
+	dbname, sourcename := b.dbname(d), b.dbname(source)
+	if !b.DatabaseExists(ctx, sourcename) {
+		return dbname, ErrDatabaseNotFound
+	}
+
+	owner, err := b.createOwner(ctx, d)
+	if err != nil {
+		return dbname, err
+	}
+
+	// a copy left over by an interrupted attempt is handed over again
+	// and its source accepts connections again
+	if !b.DatabaseExists(ctx, dbname) {
+		if err := b.copyDB(ctx, dbname, sourcename, owner); err != nil {
+			return dbname, err
+		}
+	}
+	if _, err := b.conn.ExecContext(ctx, "UPDATE pg_database SET datallowconn = $1 WHERE datname = $2", true, sourcename); err != nil {
+		return dbname, err
+	}
+
+	roles, err := b.brokerRoles(ctx, b.conn, "SELECT oid FROM pg_roles WHERE rolname = ANY($1)", pq.Array(b.groupRoles(source)))
+	if err != nil {
+		return dbname, err
+	}
+	return dbname, b.handOver(ctx, dbname, source, owner, roles)
+}
+
+// copyDB creates the named database from the named source database, the source
+// doesn't accept connections until it's done
+func (b *PGP) copyDB(ctx context.Context, dbname, sourcename, owner string) error {
+	if _, err := b.conn.ExecContext(ctx, "UPDATE pg_database SET datallowconn = $1 WHERE datname = $2", false, sourcename); err != nil {
+		return err
+	}
+	defer b.conn.ExecContext(context.Background(), "UPDATE pg_database SET datallowconn = $1 WHERE datname = $2", true, sourcename)
+
+	if _, err := b.conn.ExecContext(ctx, "SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = $1 AND pid <> pg_backend_pid()", sourcename); err != nil {
+		return err
+	}
+	_, err := b.conn.ExecContext(ctx, "CREATE DATABASE "+de(dbname)+" OWNER "+de(owner)+" TEMPLATE "+de(sourcename))
+	return err
+}
+
+// handOver reassigns objects the named roles own in the named copy of the database
+// of the named source instance to the named owner and revokes their privileges in the copy
+func (b *PGP) handOver(ctx context.Context, dbname, source, owner string, roles []string) error {
+	if len(roles) == 0 {
+		return nil
+	}
+	quoted := make([]string, len(roles))
+	for i, role := range roles {
+		quoted[i] = de(role)
+	}
+	list := strings.Join(quoted, ", ")
+
+	// REASSIGN OWNED covers databases as well, the source is kept out
+	// of it and handed back to its owner role even after a crash
+	sourcename, sourceOwner := b.dbname(source), b.groupRole(source, RoleOwner)
+	ownerExists := b.roleExists(ctx, sourceOwner)
+	if ownerExists {
+		if _, err := b.conn.ExecContext(ctx, "ALTER DATABASE "+de(sourcename)+" OWNER TO CURRENT_USER"); err != nil {
+			return err
+		}
+		defer b.conn.ExecContext(context.Background(), "ALTER DATABASE "+de(sourcename)+" OWNER TO "+de(sourceOwner))
+	}
+
+	conn, err := b.open(dbname)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "REASSIGN OWNED BY "+list+" TO "+de(owner)); err != nil {
+		return err
+	}
+
+	schemas, err := userSchemas(ctx, conn)
+	if err != nil {
+		return err
+	}
+	for _, schema := range schemas {
+		for _, statement := range []string{
+			"REVOKE ALL ON SCHEMA " + de(schema) + " FROM " + list,
+			"REVOKE ALL ON ALL TABLES IN SCHEMA " + de(schema) + " FROM " + list,
+			"REVOKE ALL ON ALL SEQUENCES IN SCHEMA " + de(schema) + " FROM " + list,
+		} {
+			if _, err := conn.ExecContext(ctx, statement); err != nil {
+				return err
+			}
+		}
+	}
+
+	// REASSIGN OWNED leaves default privileges alone, they'd keep the
+	// source roles from being dropped along with the source
+	var grantees []string
+	for _, role := range roles {
+		if role != sourceOwner {
+			grantees = append(grantees, de(role))
+		}
+	}
+	if !ownerExists || len(grantees) == 0 {
+		return nil
+	}
+	for _, objects := range []string{"TABLES", "SEQUENCES", "SCHEMAS"} {
+		_, err := conn.ExecContext(ctx, "ALTER DEFAULT PRIVILEGES FOR ROLE "+de(sourceOwner)+" REVOKE ALL ON "+objects+" FROM "+strings.Join(grantees, ", "))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createOwner creates the owner role of the named instance unless it exists,
+// it's a NOLOGIN group role owning the database and everything in it so that
+// all bindings share the same objects
+func (b *PGP) createOwner(ctx context.Context, d string) (string, error) {
+	owner := b.groupRole(d, RoleOwner)
+	if !b.roleExists(ctx, owner) {
+		if _, err := b.conn.ExecContext(ctx, "CREATE ROLE "+de(owner)+" NOLOGIN"); err != nil {
+			return "", err
+		}
+	}
+
+	// the admin user has to be a member to create and drop databases owned by the role
+	_, err := b.conn.ExecContext(ctx, "GRANT "+de(owner)+" TO CURRENT_USER")
+	return owner, err
+}
+
+// DatabaseSize returns size of the named database in bytes
+func (b *PGP) DatabaseSize(ctx context.Context, d string) (int64, error) {
+	var size int64
+	err := b.conn.QueryRowContext(ctx, "SELECT pg_database_size($1)", b.dbname(d)).Scan(&size)
+	return size, err
+}
+
+// DiskUsage returns size of all databases of the server in bytes
+func (b *PGP) DiskUsage(ctx context.Context) (int64, error) {
+	var size int64
+	err := b.conn.QueryRowContext(ctx, "SELECT COALESCE(SUM(pg_database_size(datname)), 0)::bigint FROM pg_database").Scan(&size)
+	return size, err
+}
+
+// AlterDB applies the provided settings to the named database
+func (b *PGP) AlterDB(ctx context.Context, d string, s DBSettings) error {
+	dbname := b.dbname(d)
+	if _, err := b.conn.ExecContext(ctx, fmt.Sprintf("ALTER DATABASE %s CONNECTION LIMIT %d", de(dbname), s.ConnectionLimit)); err != nil {
+		return err
+	}
+
+	query := "ALTER DATABASE " + de(dbname) + " RESET statement_timeout"
+	if s.StatementTimeout != "" {
+		query = "ALTER DATABASE " + de(dbname) + " SET statement_timeout = " + se(s.StatementTimeout)
+	}
+	_, err := b.conn.ExecContext(ctx, query)
+	return err
+}
+
+// ConfigureDB resets the named runtime settings of the named database
+// and sets the provided ones, see DBSettings for settings of plans
+func (b *PGP) ConfigureDB(ctx context.Context, d string, settings map[string]string, reset []string) error {
+	dbname := b.dbname(d)
+	for _, name := range reset {
+		if _, err := b.conn.ExecContext(ctx, "ALTER DATABASE "+de(dbname)+" RESET "+setting(name)); err != nil {
+			return err
+		}
+	}
+	for name, value := range settings {
+		if _, err := b.conn.ExecContext(ctx, "ALTER DATABASE "+de(dbname)+" SET "+setting(name)+" = "+se(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Settings returns runtime settings of the named database that differ from the server defaults
+func (b *PGP) Settings(ctx context.Context, d string) (map[string]string, error) {
+	rows, err := b.conn.QueryContext(ctx, `SELECT unnest(s.setconfig) FROM pg_db_role_setting s
+		JOIN pg_database d ON d.oid = s.setdatabase
+		WHERE d.datname = $1 AND s.setrole = 0`, b.dbname(d))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	settings := make(map[string]string)
+	for rows.Next() {
+		var setting string
+		if err := rows.Scan(&setting); err != nil {
+			return nil, err
+		}
+		if i := strings.IndexByte(setting, '='); i != -1 {
+			settings[setting[:i]] = setting[i+1:]
+		}
+	}
+	return settings, rows.Err()
+}
+
+// RestrictDB makes transactions in the named database read-only by default
+// or lifts the restriction. Sessions can override the default, so users able
+// to write cannot log in while it's restricted, see restrictWriters. Sessions
+// are terminated when anything changes so that they reconnect with it.
+func (b *PGP) RestrictDB(ctx context.Context, d string, readOnly bool) error {
+	dbname := b.dbname(d)
+
+	var restricted bool
+	if err := b.conn.QueryRowContext(ctx, `SELECT EXISTS (SELECT FROM pg_db_role_setting s
+		JOIN pg_database d ON d.oid = s.setdatabase
+		WHERE d.datname = $1 AND s.setrole = 0 AND $2 = ANY(s.setconfig))`, dbname, readOnlySetting).Scan(&restricted); err != nil {
+		return err
+	}
+	if restricted != readOnly {
+		query := "ALTER DATABASE " + de(dbname) + " RESET default_transaction_read_only"
+		if readOnly {
+			query = "ALTER DATABASE " + de(dbname) + " SET default_transaction_read_only = on"
+		}
+		if _, err := b.conn.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+
+	// users created meanwhile are caught up with even when the database is unchanged
+	writers, err := b.restrictWriters(ctx, d, readOnly)
+	if err != nil {
+		return err
+	}
+	if restricted == readOnly && len(writers) == 0 {
+		return nil
+	}
+
+	_, err = b.conn.ExecContext(ctx, `SELECT pg_terminate_backend(pid) FROM pg_stat_activity
+		WHERE (datname = $1 OR usename = ANY($2)) AND usename <> current_user`, dbname, pq.Array(writers))
+	return err
+}
+
+// restrictWriters keeps users of the named instance that are able to write,
+// members of its owner and read-write roles, from logging in or lets them log
+// in again, it returns the users it changed
+func (b *PGP) restrictWriters(ctx context.Context, d string, restricted bool) ([]string, error) {
+	writers := []string{b.groupRole(d, RoleOwner), b.groupRole(d, RoleReadWrite)}
+	rows, err := b.conn.QueryContext(ctx, `SELECT DISTINCT m.rolname FROM pg_auth_members a
+		JOIN pg_roles g ON g.oid = a.roleid
+		JOIN pg_roles m ON m.oid = a.member
+		WHERE g.rolname = ANY($1) AND m.rolname <> ALL($2) AND m.rolname <> current_user AND m.rolcanlogin = $3`,
+		pq.Array(writers), pq.Array(b.groupRoles(d)), restricted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]string, 0)
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		users = append(users, username)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	login := " LOGIN"
+	if restricted {
+		login = " NOLOGIN"
+	}
+	for _, username := range users {
+		if _, err := b.conn.ExecContext(ctx, "ALTER ROLE "+de(username)+login); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+// Extensions lists extensions installed in the named database
+func (b *PGP) Extensions(ctx context.Context, d string) ([]Extension, error) {
+	conn, err := b.open(b.dbname(d))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(ctx, "SELECT extname, extversion FROM pg_extension WHERE extname <> 'plpgsql' ORDER BY extname")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	extensions := make([]Extension, 0)
+	for rows.Next() {
+		var e Extension
+		if err := rows.Scan(&e.Name, &e.Version); err != nil {
+			return nil, err
+		}
+		extensions = append(extensions, e)
+	}
+	return extensions, rows.Err()
+}
+
+// Seed runs the provided SQL script in the named database as the instance
+// owner role in a single transaction, the database is marked as seeded in
+// it so that the script never runs twice
+func (b *PGP) Seed(ctx context.Context, d, script string) error {
 	dbname := b.dbname(d)
-	_, err := b.conn.ExecContext(ctx, "CREATE DATABASE "+de(dbname))
-	return dbname, err
+	conn, err := b.open(dbname)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var comment sql.NullString
+	if err := conn.QueryRowContext(ctx, "SELECT shobj_description(oid, 'pg_database') FROM pg_database WHERE datname = $1", dbname).Scan(&comment); err != nil {
+		return err
+	}
+	if comment.String == seededComment {
+		return nil
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range []string{
+		"COMMENT ON DATABASE " + de(dbname) + " IS " + se(seededComment),
+		"SET LOCAL ROLE " + de(b.groupRole(d, RoleOwner)),
+		script,
+	} {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// CreateExtensions installs the named extensions into the named database
+// along with extensions they require unless they're installed already
+func (b *PGP) CreateExtensions(ctx context.Context, d string, names []string) error {
+	return b.execAll(ctx, b.dbname(d), names, "CREATE EXTENSION IF NOT EXISTS %s CASCADE")
+}
+
+// DropExtensions removes the named extensions from the named database,
+// it fails when objects outside of an extension depend on it
+func (b *PGP) DropExtensions(ctx context.Context, d string, names []string) error {
+	return b.execAll(ctx, b.dbname(d), names, "DROP EXTENSION IF EXISTS %s")
+}
+
+// execAll runs the statement format with each of the named objects in the named database
+func (b *PGP) execAll(ctx context.Context, dbname string, names []string, format string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	conn, err := b.open(dbname)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, name := range names {
+		if _, err := conn.ExecContext(ctx, fmt.Sprintf(format, de(name))); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// DropDB deletes the named database
+// DropDB deletes the named database along with all broker roles that
+// have been granted privileges on it or own it, objects the roles own
+// elsewhere on the server are dropped and their grants are revoked
 func (b *PGP) DropDB(ctx context.Context, d string) error {
 	dbname := b.dbname(d)
 
-	fmt.Println("Dropdb: start datallowCon = false")
-	if _, err := b.conn.ExecContext(ctx, "UPDATE pg_database SET datallowconn = $1 WHERE datname = $2", false, dbname); err != nil {
+	// roles of the instance are listed by name as well to finish
+	// an attempt interrupted after the database has been dropped
+	roles, err := b.brokerRoles(ctx, b.conn, `SELECT (aclexplode(datacl)).grantee FROM pg_database WHERE datname = $1
+		UNION SELECT datdba FROM pg_database WHERE datname = $1
+		UNION SELECT oid FROM pg_roles WHERE rolname = ANY($2)`, dbname, pq.Array(b.groupRoles(d)))
+	if err != nil {
 		return err
 	}
 
-	fmt.Println("Dropdb: start pg_terminate_backed")
+	if _, err := b.conn.ExecContext(ctx, "UPDATE pg_database SET datallowconn = $1 WHERE datname = $2", false, dbname); err != nil {
+		return err
+	}
 	if _, err := b.conn.ExecContext(ctx, "SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = $1", dbname); err != nil {
 		return err
 	}
+	if _, err := b.conn.ExecContext(ctx, "DROP DATABASE IF EXISTS "+de(dbname)); err != nil {
+		return err
+	}
+	return b.dropRoles(ctx, b.conn, roles)
+}
 
-	// TODO: drop users
-	fmt.Println("Dropdb: start drop database")
-	_, err := b.conn.Exec("DROP DATABASE " + de(dbname))
-	return err
+// brokerRoles lists broker roles whose OIDs are selected by the provided query along
+// with their direct members, the admin user and roles of other tenants are never listed
+func (b *PGP) brokerRoles(ctx context.Context, q querier, query string, args ...interface{}) ([]string, error) {
+	n := len(args) + 1
+	rows, err := q.QueryContext(ctx, fmt.Sprintf(`WITH base AS (%s)
+		SELECT rolname FROM pg_roles
+		WHERE (oid IN (SELECT * FROM base) OR oid IN (
+			SELECT member FROM pg_auth_members WHERE roleid IN (SELECT * FROM base)
+		)) AND left(rolname, length($%d)) = $%d AND rolname <> current_user
+		ORDER BY rolname`, query, n, n), append(args, b.prefix)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := make([]string, 0)
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// dropRoles drops the named roles along with objects they own in the database
+// the provided connection is connected to revoking all their grants
+func (b *PGP) dropRoles(ctx context.Context, conn *sql.DB, roles []string) error {
+	for _, role := range roles {
+		if _, err := conn.ExecContext(ctx, "DROP OWNED BY "+de(role)); err != nil {
+			return err
+		}
+		if _, err := b.conn.ExecContext(ctx, "DROP ROLE IF EXISTS "+de(role)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// CreateUser creates a user for the named database
-func (b *PGP) CreateUser(ctx context.Context, d, u string) (*Credentials, error) {
+// CreateUser creates a user for the named database with the provided role.
+// Owners are members of the instance owner role and act as it in the database
+// so that objects they create are shared by all bindings, they're granted the
+// provided privileges on the database. Other users are members of a group role
+// granted privileges on all current and future tables and sequences.
+func (b *PGP) CreateUser(ctx context.Context, d, u string, role Role, privileges []string) (*Credentials, error) {
+	if _, ok := groupPrivileges[role]; !ok && role != RoleOwner {
+		return nil, fmt.Errorf("unknown role %q", role)
+	}
+
 	dbname := b.dbname(d)
 	if !b.DatabaseExists(ctx, dbname) {
-		return nil, fmt.Errorf("database %q doesn't exist", dbname)
+		return nil, ErrDatabaseNotFound
+	}
+
+	// databases created before owner roles existed are handed over to theirs
+	owner, err := b.createOwner(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := b.conn.ExecContext(ctx, "ALTER DATABASE "+de(dbname)+" OWNER TO "+de(owner)); err != nil {
+		return nil, err
 	}
 
 	username := b.username(u)
-	password, err := b.password(8)
+	password, err := b.createLogin(ctx, username)
 	if err != nil {
 		return nil, err
 	}
 
-	if !b.userExists(ctx, username) {
-		if _, err := b.conn.ExecContext(ctx, "CREATE USER "+de(username)+" WITH PASSWORD "+se(password)); err != nil {
+	if role == RoleOwner {
+		if _, err := b.conn.ExecContext(ctx, "GRANT "+de(owner)+" TO "+de(username)); err != nil {
+			return nil, err
+		}
+		if _, err := b.conn.ExecContext(ctx, "ALTER ROLE "+de(username)+" IN DATABASE "+de(dbname)+" SET role = "+se(owner)); err != nil {
+			return nil, err
+		}
+		if err := b.GrantDB(ctx, d, u, privileges); err != nil {
+			return nil, err
+		}
+	} else {
+		group, err := b.createGroup(ctx, d, role, dbname, "")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := b.conn.ExecContext(ctx, "GRANT "+de(group)+" TO "+de(username)); err != nil {
 			return nil, err
 		}
 	}
 
-	if _, err := b.conn.ExecContext(ctx, "GRANT ALL PRIVILEGES ON DATABASE "+de(dbname)+" TO "+de(username)); err != nil {
-		return nil, err
+	return b.credentials(username, password, dbname), nil
+}
+
+// LimitUser sets the maximum number of concurrent connections of the named user, -1 is unlimited
+func (b *PGP) LimitUser(ctx context.Context, u string, limit int) error {
+	_, err := b.conn.ExecContext(ctx, fmt.Sprintf("ALTER ROLE %s CONNECTION LIMIT %d", de(b.username(u)), limit))
+	return err
+}
+
+// createLogin creates the named user with a new random password, a user
+// left over by an interrupted attempt gets the new password
+func (b *PGP) createLogin(ctx context.Context, username string) (string, error) {
+	password, err := b.password(8)
+	if err != nil {
+		return "", err
+	}
+
+	statement := "CREATE USER "
+	if b.userExists(ctx, username) {
+		statement = "ALTER USER "
 	}
+	_, err = b.conn.ExecContext(ctx, statement+de(username)+" WITH PASSWORD "+se(password))
+	return password, err
+}
 
+// credentials builds credentials of the named user connecting to the named database
+func (b *PGP) credentials(username, password, dbname string) *Credentials {
 	source := b.source
 	source.User = url.UserPassword(username, password)
 	source.Path = dbname
@@ -125,34 +800,178 @@ func (b *PGP) CreateUser(ctx context.Context, d, u string) (*Credentials, error)
 		Host:     source.Hostname(),
 		Port:     source.Port(),
 		Url:      source.String(),
-	}, nil
+	}
 }
 
-// DropUser removes the named user
-func (b *PGP) DropUser(ctx context.Context, d, u string) error {
-	dbname := b.dbname(d)
-	username := b.username(u)
+// createGroup creates the named group role of the named instance unless it
+// exists and grants it privileges on all current objects of the named schema
+// of the named database, or of all its schemas when schema is blank, objects
+// the owner role creates later are covered by default privileges
+func (b *PGP) createGroup(ctx context.Context, d string, role Role, dbname, schema string) (string, error) {
+	owner := b.groupRole(d, RoleOwner)
+	group := b.groupRole(d, role)
+	privileges := groupPrivileges[role]
 
-	if dbname != strings.TrimLeft(b.source.Path, "/") {
-		// We need to execute this in the context of the correct database
-		source := b.source
-		source.Path = dbname
-		other, err := New(source.String())
-		if err != nil {
-			return err
+	if !b.roleExists(ctx, group) {
+		if _, err := b.conn.ExecContext(ctx, "CREATE ROLE "+de(group)+" NOLOGIN"); err != nil {
+			return "", err
 		}
-		return other.DropUser(ctx, d, u)
 	}
-	if _, err := b.conn.ExecContext(ctx, "REASSIGN OWNED BY "+de(username)+" TO "+de(b.source.User.Username())); err != nil {
-		return err
+	if _, err := b.conn.ExecContext(ctx, "GRANT CONNECT ON DATABASE "+de(dbname)+" TO "+de(group)); err != nil {
+		return "", err
+	}
+
+	conn, err := b.open(dbname)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	// databases created before the public privileges were revoked
+	// would let the group create objects
+	if schema == "" {
+		if err := restrictPublic(ctx, conn, dbname, owner); err != nil {
+			return "", err
+		}
+	}
+
+	// grants are issued as the owner of the objects
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "SET LOCAL ROLE "+de(owner)); err != nil {
+		return "", err
+	}
+
+	schemas, defaults := []string{schema}, " IN SCHEMA "+de(schema)
+	if schema == "" {
+		if schemas, err = userSchemas(ctx, tx); err != nil {
+			return "", err
+		}
+		defaults = ""
 	}
+
+	statements := make([]string, 0, 3*len(schemas)+3)
+	for _, schema := range schemas {
+		statements = append(statements,
+			"GRANT USAGE ON SCHEMA "+de(schema)+" TO "+de(group),
+			"GRANT "+privileges.tables+" ON ALL TABLES IN SCHEMA "+de(schema)+" TO "+de(group),
+			"GRANT "+privileges.sequences+" ON ALL SEQUENCES IN SCHEMA "+de(schema)+" TO "+de(group),
+		)
+	}
+	if schema == "" {
+		statements = append(statements, "ALTER DEFAULT PRIVILEGES FOR ROLE "+de(owner)+" GRANT USAGE ON SCHEMAS TO "+de(group))
+	}
+	statements = append(statements,
+		"ALTER DEFAULT PRIVILEGES FOR ROLE "+de(owner)+defaults+" GRANT "+privileges.tables+" ON TABLES TO "+de(group),
+		"ALTER DEFAULT PRIVILEGES FOR ROLE "+de(owner)+defaults+" GRANT "+privileges.sequences+" ON SEQUENCES TO "+de(group),
+	)
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return "", err
+		}
+	}
+	return group, tx.Commit()
+}
+
+// userSchemas lists schemas of the database the provided querier is connected to
+// leaving out the system ones
+func userSchemas(ctx context.Context, q querier) ([]string, error) {
+	rows, err := q.QueryContext(ctx, `SELECT nspname FROM pg_namespace
+		WHERE nspname !~ '^pg_' AND nspname <> 'information_schema' ORDER BY nspname`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schemas := make([]string, 0)
+	for rows.Next() {
+		var schema string
+		if err := rows.Scan(&schema); err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, schema)
+	}
+	return schemas, rows.Err()
+}
+
+// GrantDB replaces privileges of the named user on the named database
+func (b *PGP) GrantDB(ctx context.Context, d, u string, privileges []string) error {
+	dbname := b.dbname(d)
+	username := b.username(u)
+
 	if _, err := b.conn.ExecContext(ctx, "REVOKE ALL PRIVILEGES ON DATABASE "+de(dbname)+" FROM "+de(username)); err != nil {
 		return err
 	}
+	_, err := b.conn.ExecContext(ctx, "GRANT "+strings.Join(privileges, ", ")+" ON DATABASE "+de(dbname)+" TO "+de(username))
+	return err
+}
+
+// DropUser removes the named user, it's a no-op when the user doesn't exist
+func (b *PGP) DropUser(ctx context.Context, d, u string) error {
+	return b.dropUser(ctx, b.dbname(d), b.groupRole(d, RoleOwner), b.username(u))
+}
+
+// dropUser removes the named user of the named database handing objects it
+// owns over to the named owner role, or to the admin user for databases
+// created before owner roles existed
+func (b *PGP) dropUser(ctx context.Context, dbname, owner, username string) error {
+	if !b.userExists(ctx, username) {
+		return nil
+	}
+
+	// the user cannot own anything in a database that is gone
+	if b.DatabaseExists(ctx, dbname) {
+		conn, err := b.open(dbname)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		if !b.roleExists(ctx, owner) {
+			owner = b.source.User.Username()
+		}
+		if _, err := conn.ExecContext(ctx, "REASSIGN OWNED BY "+de(username)+" TO "+de(owner)); err != nil {
+			return err
+		}
+		if _, err := conn.ExecContext(ctx, "DROP OWNED BY "+de(username)); err != nil {
+			return err
+		}
+	}
+
 	_, err := b.conn.ExecContext(ctx, "DROP USER "+de(username))
 	return err
 }
 
+// DBName returns name of the database of the named instance
+func (b *PGP) DBName(d string) string {
+	return b.dbname(d)
+}
+
+// open connects to the named database of the same server
+func (b *PGP) open(dbname string) (*sql.DB, error) {
+	source := b.source
+	source.Path = dbname
+
+	// databases over quota are read-only by default but not for the broker
+	query := source.Query()
+	query.Set("default_transaction_read_only", "off")
+	source.RawQuery = query.Encode()
+	return sql.Open("postgres", source.String())
+}
+
+// setting quotes the named runtime setting name, parts of custom ones separately
+func setting(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = de(part)
+	}
+	return strings.Join(parts, ".")
+}
+
 // dbname prefixes the named database name
 func (b *PGP) dbname(d string) string {
 	return b.prefix + d
@@ -163,6 +982,16 @@ func (b *PGP) username(u string) string {
 	return b.prefix + u
 }
 
+// groupRole returns name of the named group role of the named instance
+func (b *PGP) groupRole(d string, role Role) string {
+	return b.prefix + d + "_" + string(role)
+}
+
+// groupRoles returns names of all group roles of the named instance
+func (b *PGP) groupRoles(d string) []string {
+	return []string{b.groupRole(d, RoleOwner), b.groupRole(d, RoleReadWrite), b.groupRole(d, RoleReadOnly)}
+}
+
 // password generates a random password
 func (b *PGP) password(size int) (string, error) {
 	buf := make([]byte, size)
@@ -172,7 +1001,17 @@ func (b *PGP) password(size int) (string, error) {
 	return base64.URLEncoding.EncodeToString(buf), nil
 }
 
-// userExists checks whether the named database exists
+// InstanceExists checks whether the database of the named instance exists
+func (b *PGP) InstanceExists(ctx context.Context, d string) bool {
+	return b.DatabaseExists(ctx, b.dbname(d))
+}
+
+// UserExists checks whether the named user exists
+func (b *PGP) UserExists(ctx context.Context, u string) bool {
+	return b.userExists(ctx, b.username(u))
+}
+
+// DatabaseExists checks whether the named database exists
 func (b *PGP) DatabaseExists(ctx context.Context, dbname string) bool {
 	return b.exists(ctx, "pg_database", "datname", dbname)
 }
@@ -182,6 +1021,11 @@ func (b *PGP) userExists(ctx context.Context, username string) bool {
 	return b.exists(ctx, "pg_user", "usename", username)
 }
 
+// roleExists checks whether the named role exists, unlike users roles may be NOLOGIN
+func (b *PGP) roleExists(ctx context.Context, role string) bool {
+	return b.exists(ctx, "pg_roles", "rolname", role)
+}
+
 // exists checks whether the named column is exists in the provided table name
 // and it equals to the specified value
 func (b *PGP) exists(ctx context.Context, table, column, value string) bool {
@@ -190,12 +1034,56 @@ func (b *PGP) exists(ctx context.Context, table, column, value string) bool {
 	return num != ""
 }
 
-// de double-quotes the named string safely escaping it
+// Transient checks whether the named error is likely to go away when the
+// failed statement is retried, like lost connections, lock conflicts and
+// databases that are still in use
+func Transient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == driver.ErrBadConn || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+
+	switch c := code(err); {
+	case c == "":
+		return false
+	case c == "55006", c == "55P03": // object_in_use, lock_not_available
+		return true
+	default:
+		// connection_exception, transaction_rollback,
+		// insufficient_resources and operator_intervention
+		switch c.Class() {
+		case "08", "40", "53", "57":
+			return true
+		}
+	}
+	return false
+}
+
+// querier runs queries on a database or within a transaction
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// code returns SQLSTATE of the named error when it's reported by the server
+func code(err error) pq.ErrorCode {
+	if err, ok := err.(*pq.Error); ok {
+		return err.Code
+	}
+	return ""
+}
+
+// de double-quotes the named identifier doubling quotes inside
+// of it, Go string quoting would let them end the identifier
 func de(s string) string {
-	return fmt.Sprintf("%q", s)
+	return pq.QuoteIdentifier(s)
 }
 
 // se single-quotes the named string safely escaping it
 func se(s string) string {
-	return "'" + strings.Replace(s, "'", "\\'", -1) + "'"
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
 }
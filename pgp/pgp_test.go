@@ -1,17 +1,37 @@
 package pgp
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net/url"
 	"os"
+	"reflect"
 	"testing"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 const testDB = "test_foo"
 const testUser = "test_bar"
 
+func TestQuote(t *testing.T) {
+	for s, want := range map[string]string{
+		`foo`:                `"foo"`,
+		`x"; RESET ROLE; --`: `"x""; RESET ROLE; --"`,
+		`back\slash "quote"`: `"back\slash ""quote"""`,
+	} {
+		if got := de(s); got != want {
+			t.Errorf("de(%s) = %s, want %s", s, got, want)
+		}
+	}
+	if got := se(`it's`); got != `'it''s'` {
+		t.Errorf("se = %s", got)
+	}
+}
+
 func TestNew(t *testing.T) {
 	if _, err := newPGP(t); err != nil {
 		t.Fatal("cannot connect to DB", err)
@@ -32,7 +52,7 @@ func TestCreateAndDropDB(t *testing.T) {
 
 	defer pgp.conn.Exec(`DROP DATABASE $1`, dbname)
 
-	dbname, err = pgp.CreateDB(context.Background(), testDB)
+	dbname, err = pgp.CreateDB(context.Background(), testDB, DBOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -45,6 +65,10 @@ func TestCreateAndDropDB(t *testing.T) {
 		t.Fatal("database doesn't exist")
 	}
 
+	if !pgp.roleExists(context.Background(), pgp.groupRole(testDB, RoleOwner)) {
+		t.Fatal("owner role doesn't exist")
+	}
+
 	if err := pgp.DropDB(context.Background(), testDB); err != nil {
 		t.Fatal(err)
 	}
@@ -52,6 +76,10 @@ func TestCreateAndDropDB(t *testing.T) {
 	if pgp.DatabaseExists(context.Background(), dbname) {
 		t.Fatal("database still exists")
 	}
+
+	if pgp.roleExists(context.Background(), pgp.groupRole(testDB, RoleOwner)) {
+		t.Fatal("owner role still exists")
+	}
 }
 
 func TestCreateAndDropUser(t *testing.T) {
@@ -61,12 +89,12 @@ func TestCreateAndDropUser(t *testing.T) {
 	}
 
 	username := pgp.username(testUser)
-	if _, err := pgp.CreateDB(context.Background(), testDB); err != nil {
+	if _, err := pgp.CreateDB(context.Background(), testDB, DBOptions{}); err != nil {
 		t.Fatal(err)
 	}
 	defer pgp.DropDB(context.Background(), testDB)
 
-	creds, err := pgp.CreateUser(context.Background(), testDB, testUser)
+	creds, err := pgp.CreateUser(context.Background(), testDB, testUser, RoleOwner, []string{"ALL"})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -104,6 +132,118 @@ func TestCreateAndDropUser(t *testing.T) {
 	}
 }
 
+func TestCreateReadOnlyUser(t *testing.T) {
+	pgp, err := newPGP(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pgp.CreateDB(context.Background(), testDB, DBOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	defer pgp.DropDB(context.Background(), testDB)
+
+	owner, err := pgp.CreateUser(context.Background(), testDB, testUser, RoleOwner, []string{"ALL"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec := func(url, query string) error {
+		conn, err := sql.Open("postgres", url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_, err = conn.Exec(query)
+		return err
+	}
+	if err := exec(owner.Url, "CREATE TABLE before_reader (id int)"); err != nil {
+		t.Fatal(err)
+	}
+	// schema names are quoted in grants
+	if err := exec(owner.Url, `CREATE SCHEMA "a""; RESET ROLE; --"; CREATE TABLE "a""; RESET ROLE; --".quoted (id int)`); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := pgp.CreateUser(context.Background(), testDB, testUser+"_reader", RoleReadOnly, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exec(owner.Url, "CREATE TABLE after_reader (id int)"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range []string{"before_reader", "after_reader", `"a""; RESET ROLE; --".quoted`} {
+		if err := exec(reader.Url, "SELECT * FROM "+table); err != nil {
+			t.Fatalf("%s: %v", table, err)
+		}
+		if err := exec(reader.Url, "INSERT INTO "+table+" VALUES (1)"); err == nil {
+			t.Fatalf("%s: read-only user has inserted a row", table)
+		}
+	}
+
+	// PostgreSQL 14 and older let everyone create in the public schema
+	if err := exec(reader.Url, "CREATE TABLE by_reader (id int)"); err == nil {
+		t.Fatal("read-only user has created a table")
+	}
+	if err := exec(reader.Url, "CREATE TEMPORARY TABLE by_reader (id int)"); err == nil {
+		t.Fatal("read-only user has created a temporary table")
+	}
+	if err := exec(owner.Url, "CREATE TEMPORARY TABLE by_owner (id int)"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pgp.DropUser(context.Background(), testDB, testUser+"_reader"); err != nil {
+		t.Fatal(err)
+	}
+	if pgp.userExists(context.Background(), pgp.username(testUser+"_reader")) {
+		t.Fatal("user still exists")
+	}
+}
+
+func TestDropDBDropsUsers(t *testing.T) {
+	pgp, err := newPGP(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pgp.CreateDB(context.Background(), testDB, DBOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	defer pgp.DropDB(context.Background(), testDB)
+
+	if _, err := pgp.CreateUser(context.Background(), testDB, testUser, RoleOwner, []string{"ALL"}); err != nil {
+		t.Fatal(err)
+	}
+	defer pgp.DropUser(context.Background(), testDB, testUser)
+
+	if err := pgp.DropDB(context.Background(), testDB); err != nil {
+		t.Fatal(err)
+	}
+
+	if pgp.userExists(context.Background(), pgp.username(testUser)) {
+		t.Fatal("user still exists")
+	}
+}
+
+func TestTransient(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("boom"), false},
+		{driver.ErrBadConn, true},
+		{&pq.Error{Code: "55006"}, true},
+		{&pq.Error{Code: "40P01"}, true},
+		{&pq.Error{Code: "57P01"}, true},
+		{&pq.Error{Code: "42P04"}, false},
+	} {
+		if got := Transient(tc.err); got != tc.want {
+			t.Errorf("Transient(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
 func newPGP(t *testing.T) (*PGP, error) {
 	source := os.Getenv("PG_SOURCE")
 	if source == "" {
@@ -112,3 +252,343 @@ func newPGP(t *testing.T) (*PGP, error) {
 
 	return New(os.Getenv("PG_SOURCE"))
 }
+
+func TestRestrictDB(t *testing.T) {
+	pgp, err := newPGP(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if _, err := pgp.CreateDB(ctx, testDB, DBOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	defer pgp.DropDB(ctx, testDB)
+
+	creds, err := pgp.CreateUser(ctx, testDB, testUser, RoleOwner, []string{"ALL"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec := func(query string) error {
+		conn, err := sql.Open("postgres", creds.Url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_, err = conn.Exec(query)
+		return err
+	}
+
+	reader, err := pgp.CreateUser(ctx, testDB, testUser+"_reader", RoleReadOnly, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pgp.DropUser(ctx, testDB, testUser+"_reader")
+
+	if err := pgp.RestrictDB(ctx, testDB, true); err != nil {
+		t.Fatal(err)
+	}
+	// writers cannot override the read-only default as they cannot log in
+	if err := exec("SET default_transaction_read_only = off; CREATE TABLE foo (id int)"); code(err) != "28000" {
+		t.Fatalf("err = %v, want login error", err)
+	}
+	conn, err := sql.Open("postgres", reader.Url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Exec("SELECT 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the broker keeps managing restricted databases
+	if err := pgp.GrantDB(ctx, testDB, testUser, []string{"ALL"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pgp.RestrictDB(ctx, testDB, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec("CREATE TABLE foo (id int)"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLimitUser(t *testing.T) {
+	pgp, err := newPGP(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if _, err := pgp.CreateDB(ctx, testDB, DBOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	defer pgp.DropDB(ctx, testDB)
+
+	if _, err := pgp.CreateUser(ctx, testDB, testUser, RoleOwner, []string{"ALL"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pgp.LimitUser(ctx, testUser, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	var limit int
+	if err := pgp.conn.QueryRow("SELECT rolconnlimit FROM pg_roles WHERE rolname = $1", pgp.username(testUser)).Scan(&limit); err != nil {
+		t.Fatal(err)
+	}
+	if limit != 5 {
+		t.Fatalf("limit = %d, want 5", limit)
+	}
+}
+
+func TestConfigureDB(t *testing.T) {
+	pgp, err := newPGP(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if _, err := pgp.CreateDB(ctx, testDB, DBOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	defer pgp.DropDB(ctx, testDB)
+
+	if err := pgp.ConfigureDB(ctx, testDB, map[string]string{"work_mem": "8192", "timezone": "UTC"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := pgp.ConfigureDB(ctx, testDB, nil, []string{"timezone"}); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := pgp.Settings(ctx, testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(settings) != 1 || settings["work_mem"] != "8192" {
+		t.Fatalf("settings = %v", settings)
+	}
+}
+
+func TestValidateDBOptions(t *testing.T) {
+	pgp, err := newPGP(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if err := pgp.ValidateDBOptions(ctx, DBOptions{Encoding: "UTF8", LCCollate: "C", LCCtype: "C", Template: "template0"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []DBOptions{
+		{Encoding: "KLINGON"},
+		{LCCollate: "tlh_QO.utf8"},
+		{Template: "postgres"},
+	} {
+		if _, ok := pgp.ValidateDBOptions(ctx, opts).(UnsupportedError); !ok {
+			t.Errorf("%+v: has been accepted", opts)
+		}
+	}
+}
+
+func TestCreateAndDropExtensions(t *testing.T) {
+	pgp, err := newPGP(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if _, err := pgp.CreateDB(ctx, testDB, DBOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	defer pgp.DropDB(ctx, testDB)
+
+	// repeated creation is a no-op
+	for i := 0; i < 2; i++ {
+		if err := pgp.CreateExtensions(ctx, testDB, []string{"pgcrypto"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	extensions, err := pgp.Extensions(ctx, testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(extensions) != 1 || extensions[0].Name != "pgcrypto" || extensions[0].Version == "" {
+		t.Fatalf("extensions = %v", extensions)
+	}
+
+	if err := pgp.DropExtensions(ctx, testDB, []string{"pgcrypto"}); err != nil {
+		t.Fatal(err)
+	}
+	if extensions, err = pgp.Extensions(ctx, testDB); err != nil || len(extensions) != 0 {
+		t.Fatalf("extensions = %v, err = %v", extensions, err)
+	}
+
+	// required extensions are created along with them
+	if err := pgp.CreateExtensions(ctx, testDB, []string{"earthdistance"}); err != nil {
+		t.Fatal(err)
+	}
+	if extensions, err = pgp.Extensions(ctx, testDB); err != nil || len(extensions) != 2 || extensions[0].Name != "cube" {
+		t.Fatalf("extensions = %v, err = %v", extensions, err)
+	}
+}
+
+func TestSeed(t *testing.T) {
+	pgp, err := newPGP(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if _, err := pgp.CreateDB(ctx, testDB, DBOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	defer pgp.DropDB(ctx, testDB)
+
+	if err := pgp.Seed(ctx, testDB, "CREATE TABLE foo (id int); SELECT 1/0"); err == nil {
+		t.Fatal("failing seed has succeeded")
+	}
+
+	// the failed seed has been rolled back and the script runs once only
+	for i := 0; i < 2; i++ {
+		if err := pgp.Seed(ctx, testDB, "CREATE TABLE foo (id int); INSERT INTO foo VALUES (1)"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn, err := pgp.open(pgp.dbname(testDB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var owner string
+	if err := conn.QueryRow("SELECT tableowner FROM pg_tables WHERE tablename = 'foo'").Scan(&owner); err != nil {
+		t.Fatal(err)
+	}
+	if owner != pgp.groupRole(testDB, RoleOwner) {
+		t.Fatalf("owner = %q, want %q", owner, pgp.groupRole(testDB, RoleOwner))
+	}
+}
+
+func TestCloneDB(t *testing.T) {
+	pgp, err := newPGP(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	clone := testDB + "_clone"
+
+	if _, err := pgp.CreateDB(ctx, testDB, DBOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	defer pgp.DropDB(ctx, testDB)
+
+	if _, err := pgp.CreateUser(ctx, testDB, testUser, RoleOwner, []string{"ALL"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pgp.Seed(ctx, testDB, `CREATE TABLE foo (id int); INSERT INTO foo VALUES (1);
+		CREATE SCHEMA "a""; RESET ROLE; --"`); err != nil {
+		t.Fatal(err)
+	}
+
+	// cloning again picks up where a previous attempt stopped
+	for i := 0; i < 2; i++ {
+		if _, err := pgp.CloneDB(ctx, clone, testDB); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer pgp.DropDB(ctx, clone)
+
+	var owner string
+	var allowed bool
+	if err := pgp.conn.QueryRow("SELECT pg_get_userbyid(datdba), datallowconn FROM pg_database WHERE datname = $1", pgp.dbname(testDB)).Scan(&owner, &allowed); err != nil {
+		t.Fatal(err)
+	}
+	if owner != pgp.groupRole(testDB, RoleOwner) || !allowed {
+		t.Fatalf("source owner = %q, allowed = %v", owner, allowed)
+	}
+
+	// the copy is independent of the roles of the source
+	if err := pgp.DropDB(ctx, testDB); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := pgp.open(pgp.dbname(clone))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var n int
+	if err := conn.QueryRow("SELECT count(*) FROM foo").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("rows = %d, want 1", n)
+	}
+	if err := conn.QueryRow("SELECT tableowner FROM pg_tables WHERE tablename = 'foo'").Scan(&owner); err != nil {
+		t.Fatal(err)
+	}
+	if owner != pgp.groupRole(clone, RoleOwner) {
+		t.Fatalf("owner = %q, want %q", owner, pgp.groupRole(clone, RoleOwner))
+	}
+
+	// schema names are quoted when they're handed over
+	if err := conn.QueryRow(`SELECT pg_get_userbyid(nspowner) FROM pg_namespace WHERE nspname = 'a"; RESET ROLE; --'`).Scan(&owner); err != nil {
+		t.Fatal(err)
+	}
+	if owner != pgp.groupRole(clone, RoleOwner) {
+		t.Fatalf("schema owner = %q, want %q", owner, pgp.groupRole(clone, RoleOwner))
+	}
+}
+
+func TestDump(t *testing.T) {
+	pgp, err := newPGP(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if _, err := pgp.CreateDB(ctx, testDB, DBOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	defer pgp.DropDB(ctx, testDB)
+
+	if err := pgp.Seed(ctx, testDB, "CREATE TABLE foo (id int)"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := pgp.Dump(ctx, testDB, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("PGDMP")) {
+		t.Fatalf("dump = %q", buf.Bytes())
+	}
+
+	if err := pgp.Dump(ctx, "missing", &buf); err == nil {
+		t.Fatal("missing database has been dumped")
+	}
+}
+
+func TestDumpEnv(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{``, []string{"PGSSLMODE=require"}},
+		{`sslmode=verify-full&sslrootcert=/etc/ca.pem&connect_timeout=5&fallback_application_name=broker`,
+			[]string{"PGCONNECT_TIMEOUT=5", "PGSSLMODE=verify-full", "PGSSLROOTCERT=/etc/ca.pem"}},
+		{`sslmode=disable&options=-c%20geqo%3Doff&search_path=a%20b`,
+			[]string{"PGSSLMODE=disable", `PGOPTIONS=-c geqo=off -c search_path=a\ b`}},
+	} {
+		query, err := url.ParseQuery(tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := dumpEnv(query); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: env = %q, want %q", tc.query, got, tc.want)
+		}
+	}
+}
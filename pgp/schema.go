@@ -0,0 +1,250 @@
+package pgp
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrSchemaExists is returned when the schema to create already exists
+	ErrSchemaExists = errors.New("schema already exists")
+
+	// ErrSchemaNotFound is returned when the named schema doesn't exist
+	ErrSchemaNotFound = errors.New("schema doesn't exist")
+)
+
+// CreateSchema creates the schema of the named instance in the named shared
+// database, the schema is owned by the instance owner role that is only
+// allowed to connect to the shared database
+func (b *PGP) CreateSchema(ctx context.Context, db, d string) (string, error) {
+	schema := b.dbname(d)
+	if err := b.createSharedDB(ctx, db); err != nil {
+		return schema, err
+	}
+
+	owner, err := b.createOwner(ctx, d)
+	if err != nil {
+		return schema, err
+	}
+	if _, err := b.conn.ExecContext(ctx, "GRANT CONNECT ON DATABASE "+de(db)+" TO "+de(owner)); err != nil {
+		return schema, err
+	}
+
+	conn, err := b.open(db)
+	if err != nil {
+		return schema, err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "CREATE SCHEMA "+de(schema)+" AUTHORIZATION "+de(owner))
+	if code(err) == "42P06" {
+		return schema, ErrSchemaExists
+	}
+	return schema, err
+}
+
+// createSharedDB creates the named shared database unless it exists, nobody
+// but roles of its instances may connect to it or create objects in public
+func (b *PGP) createSharedDB(ctx context.Context, db string) error {
+	if b.DatabaseExists(ctx, db) {
+		return nil
+	}
+
+	// instances provisioned concurrently race for the shared database
+	if _, err := b.conn.ExecContext(ctx, "CREATE DATABASE "+de(db)); err != nil && code(err) != "42P04" {
+		return err
+	}
+	if _, err := b.conn.ExecContext(ctx, "REVOKE ALL ON DATABASE "+de(db)+" FROM PUBLIC"); err != nil {
+		return err
+	}
+
+	conn, err := b.open(db)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "REVOKE ALL ON SCHEMA public FROM PUBLIC")
+	return err
+}
+
+// DropSchema deletes the schema of the named instance from the named shared
+// database along with all broker roles that have been granted privileges on
+// it or own it, sessions of the roles are terminated first
+func (b *PGP) DropSchema(ctx context.Context, db, d string) error {
+	schema := b.dbname(d)
+
+	// roles are dropped even when the shared database is gone
+	conn := b.conn
+	if b.DatabaseExists(ctx, db) {
+		other, err := b.open(db)
+		if err != nil {
+			return err
+		}
+		defer other.Close()
+		conn = other
+	}
+
+	roles, err := b.brokerRoles(ctx, conn, `SELECT (aclexplode(nspacl)).grantee FROM pg_namespace WHERE nspname = $1
+		UNION SELECT nspowner FROM pg_namespace WHERE nspname = $1
+		UNION SELECT oid FROM pg_roles WHERE rolname = ANY($2)`, schema, pq.Array(b.groupRoles(d)))
+	if err != nil {
+		return err
+	}
+
+	if _, err := b.conn.ExecContext(ctx, "SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE usename = ANY($1)", pq.Array(roles)); err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, "DROP SCHEMA IF EXISTS "+de(schema)+" CASCADE"); err != nil {
+		return err
+	}
+	return b.dropRoles(ctx, conn, roles)
+}
+
+// CreateSchemaUser creates a user confined to the schema of the named instance
+// in the named shared database with the provided role, see CreateUser
+func (b *PGP) CreateSchemaUser(ctx context.Context, db, d, u string, role Role) (*Credentials, error) {
+	if _, ok := groupPrivileges[role]; !ok && role != RoleOwner {
+		return nil, fmt.Errorf("unknown role %q", role)
+	}
+
+	schema := b.dbname(d)
+	exists, err := b.SchemaExists(ctx, db, d)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrSchemaNotFound
+	}
+
+	username := b.username(u)
+	password, err := b.createLogin(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	statements := []string{
+		"GRANT CONNECT ON DATABASE " + de(db) + " TO " + de(username),
+		"ALTER ROLE " + de(username) + " IN DATABASE " + de(db) + " SET search_path = " + de(schema),
+	}
+	if role == RoleOwner {
+		owner := b.groupRole(d, RoleOwner)
+		statements = append(statements,
+			"GRANT "+de(owner)+" TO "+de(username),
+			"ALTER ROLE "+de(username)+" IN DATABASE "+de(db)+" SET role = "+se(owner),
+		)
+	} else {
+		group, err := b.createGroup(ctx, d, role, db, schema)
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, "GRANT "+de(group)+" TO "+de(username))
+	}
+	for _, statement := range statements {
+		if _, err := b.conn.ExecContext(ctx, statement); err != nil {
+			return nil, err
+		}
+	}
+
+	creds := b.credentials(username, password, db)
+	creds.Schema = schema
+	return creds, nil
+}
+
+// DropSchemaUser removes the named user of the schema of the named instance
+// in the named shared database, it's a no-op when the user doesn't exist
+func (b *PGP) DropSchemaUser(ctx context.Context, db, d, u string) error {
+	return b.dropUser(ctx, db, b.groupRole(d, RoleOwner), b.username(u))
+}
+
+// SchemaSize returns size of all relations in the schema of the named instance in bytes
+func (b *PGP) SchemaSize(ctx context.Context, db, d string) (int64, error) {
+	conn, err := b.open(db)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var size int64
+	err = conn.QueryRowContext(ctx, `SELECT COALESCE(SUM(pg_total_relation_size(c.oid)), 0)::bigint
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = $1 AND c.relkind IN ('r', 'm', 'p')`, b.dbname(d)).Scan(&size)
+	return size, err
+}
+
+// RestrictSchema makes transactions of users of the named instance in the
+// named shared database read-only by default or lifts the restriction,
+// users able to write cannot log in while it's restricted and sessions of
+// users it changes for are terminated, see RestrictDB
+func (b *PGP) RestrictSchema(ctx context.Context, db, d string, readOnly bool) error {
+	rows, err := b.conn.QueryContext(ctx, `SELECT DISTINCT m.rolname, EXISTS (SELECT FROM pg_db_role_setting s
+			JOIN pg_database d ON d.oid = s.setdatabase
+			WHERE d.datname = $1 AND s.setrole = m.oid AND $3 = ANY(s.setconfig))
+		FROM pg_auth_members a
+		JOIN pg_roles g ON g.oid = a.roleid
+		JOIN pg_roles m ON m.oid = a.member
+		WHERE g.rolname = ANY($2) AND m.rolname <> ALL($2) AND m.rolname <> current_user`,
+		db, pq.Array(b.groupRoles(d)), readOnlySetting)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	users := make([]string, 0)
+	for rows.Next() {
+		var username string
+		var restricted bool
+		if err := rows.Scan(&username, &restricted); err != nil {
+			return err
+		}
+		if restricted != readOnly {
+			users = append(users, username)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, username := range users {
+		query := "ALTER ROLE " + de(username) + " IN DATABASE " + de(db) + " RESET default_transaction_read_only"
+		if readOnly {
+			query = "ALTER ROLE " + de(username) + " IN DATABASE " + de(db) + " SET default_transaction_read_only = on"
+		}
+		if _, err := b.conn.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+
+	writers, err := b.restrictWriters(ctx, d, readOnly)
+	if err != nil {
+		return err
+	}
+	users = append(users, writers...)
+
+	_, err = b.conn.ExecContext(ctx, "SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE usename = ANY($1)", pq.Array(users))
+	return err
+}
+
+// SchemaExists checks whether the schema of the named instance exists in the named shared database
+func (b *PGP) SchemaExists(ctx context.Context, db, d string) (bool, error) {
+	if !b.DatabaseExists(ctx, db) {
+		return false, nil
+	}
+
+	conn, err := b.open(db)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	var exists bool
+	err = conn.QueryRowContext(ctx, "SELECT true FROM pg_namespace WHERE nspname = $1", b.dbname(d)).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return exists, err
+}
@@ -0,0 +1,65 @@
+package pgp
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+const testSharedDB = "test_shared"
+
+func TestCreateAndDropSchema(t *testing.T) {
+	pgp, err := newPGP(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	defer pgp.conn.Exec("DROP DATABASE IF EXISTS " + testSharedDB)
+
+	if _, err := pgp.CreateSchema(ctx, testSharedDB, testDB); err != nil {
+		t.Fatal(err)
+	}
+	defer pgp.DropSchema(ctx, testSharedDB, testDB)
+
+	if _, err := pgp.CreateSchema(ctx, testSharedDB, testDB); err != ErrSchemaExists {
+		t.Fatalf("err = %v, want %v", err, ErrSchemaExists)
+	}
+
+	creds, err := pgp.CreateSchemaUser(ctx, testSharedDB, testDB, testUser, RoleOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.Schema != pgp.dbname(testDB) {
+		t.Fatalf("schema = %q, want %q", creds.Schema, pgp.dbname(testDB))
+	}
+
+	// unqualified tables end up in the instance schema
+	func() {
+		conn, err := sql.Open("postgres", creds.Url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if _, err := conn.Exec("CREATE TABLE foo (id int)"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Exec("CREATE TABLE public.foo (id int)"); err == nil {
+			t.Fatal("table has been created in public")
+		}
+	}()
+
+	if err := pgp.DropSchema(ctx, testSharedDB, testDB); err != nil {
+		t.Fatal(err)
+	}
+
+	if exists, err := pgp.SchemaExists(ctx, testSharedDB, testDB); err != nil || exists {
+		t.Fatalf("exists = %v, err = %v", exists, err)
+	}
+	if pgp.userExists(ctx, pgp.username(testUser)) {
+		t.Fatal("user still exists")
+	}
+	if pgp.roleExists(ctx, pgp.groupRole(testDB, RoleOwner)) {
+		t.Fatal("owner role still exists")
+	}
+}
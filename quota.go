@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/vchrisr/cf-postgresql-broker/store"
+)
+
+// quotaInterval is how often instance sizes are checked against plan quotas
+const quotaInterval = time.Minute
+
+// monitor checks instance sizes against plan quotas periodically
+func (sb *serviceBroker) monitor(ctx context.Context) {
+	ticker := time.NewTicker(quotaInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := sb.checkQuotas(ctx); err != nil {
+			sb.logger.Error("check-quotas", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkQuotas records sizes of all instances, instances over their plan
+// quota are made read-only and restored once they're below it again
+func (sb *serviceBroker) checkQuotas(ctx context.Context) error {
+	instances, err := sb.store.Instances(ctx)
+	if err != nil {
+		return err
+	}
+
+	c := sb.catalog()
+	for _, instance := range instances {
+		if err := sb.checkQuota(ctx, c, instance); err != nil {
+			sb.logger.Error("check-quota", err, lager.Data{"instance": instance.ID})
+		}
+	}
+	return nil
+}
+
+// checkQuota enforces the plan quota of the provided instance
+func (sb *serviceBroker) checkQuota(ctx context.Context, c *catalog, instance *store.Instance) error {
+	// databases of instances being provisioned or deprovisioned come and go
+	op, err := sb.inProgress(ctx, instance.ID, "")
+	if err != nil {
+		return err
+	}
+	if op != nil && (op.Kind == opProvision || op.Kind == opDeprovision) {
+		return nil
+	}
+
+	// other broker instances check the same instances
+	release, ok, err := sb.store.TryLock(ctx, "quota:"+instance.ID)
+	if err != nil || !ok {
+		return err
+	}
+	defer release()
+
+	size, err := sb.instanceSize(ctx, instance)
+	if err != nil {
+		return err
+	}
+	quota := c.planSettings(instance.PlanID).MaxSizeMB << 20
+	exceeded := quota != 0 && size > quota
+
+	// restrictions are reapplied to catch up with users created meanwhile
+	if exceeded || instance.QuotaExceeded {
+		conn, err := sb.backendOf(instance)
+		if err != nil {
+			return err
+		}
+		if instance.SharedDatabase != "" {
+			err = conn.RestrictSchema(ctx, instance.SharedDatabase, instance.ID, exceeded)
+		} else {
+			err = conn.RestrictDB(ctx, instance.ID, exceeded)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if exceeded != instance.QuotaExceeded {
+		sb.logger.Info("quota", lager.Data{"instance": instance.ID, "size": size, "quota": quota, "exceeded": exceeded})
+	}
+
+	err = sb.store.UpdateUsage(ctx, instance.ID, size, exceeded)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// usage describes the quota state of the provided instance in instance details
+func usage(c *catalog, instance *store.Instance) map[string]interface{} {
+	return map[string]interface{}{
+		"size_mb":        instance.Size >> 20,
+		"max_size_mb":    c.planSettings(instance.PlanID).MaxSizeMB,
+		"quota_exceeded": instance.QuotaExceeded,
+	}
+}
+
+// metrics serves sizes and quota states of all instances in the Prometheus text format
+func (sb *serviceBroker) metrics(w http.ResponseWriter, r *http.Request) {
+	instances, err := sb.store.Instances(r.Context())
+	if err != nil {
+		sb.logger.Error("metrics", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w, sb.catalog(), instances)
+}
+
+// writeMetrics writes instance metrics in the Prometheus text format
+func writeMetrics(w io.Writer, c *catalog, instances []*store.Instance) {
+	for _, m := range []struct {
+		name  string
+		help  string
+		value func(*store.Instance) int64
+	}{
+		{"postgresql_broker_instance_size_bytes", "Size of the instance database or schema.", func(i *store.Instance) int64 {
+			return i.Size
+		}},
+		{"postgresql_broker_instance_quota_bytes", "Size quota of the instance plan, zero is unlimited.", func(i *store.Instance) int64 {
+			return c.planSettings(i.PlanID).MaxSizeMB << 20
+		}},
+		{"postgresql_broker_instance_quota_exceeded", "Whether the instance is read-only for exceeding its quota.", func(i *store.Instance) int64 {
+			if i.QuotaExceeded {
+				return 1
+			}
+			return 0
+		}},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name)
+		for _, i := range instances {
+			fmt.Fprintf(w, "%s{instance=%q,plan=%q,backend=%q} %d\n", m.name, i.ID, i.PlanID, i.Backend, m.value(i))
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/vchrisr/cf-postgresql-broker/store"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	c := &catalog{settings: map[string]planSettings{"small": {MaxSizeMB: 1}}}
+	instances := []*store.Instance{
+		{ID: "a", PlanID: "small", Backend: "default", Size: 2 << 20, QuotaExceeded: true},
+		{ID: "b", PlanID: "unlimited", Backend: "other", Size: 1024},
+	}
+
+	var buf bytes.Buffer
+	writeMetrics(&buf, c, instances)
+	for _, want := range []string{
+		"# TYPE postgresql_broker_instance_size_bytes gauge\n",
+		`postgresql_broker_instance_size_bytes{instance="a",plan="small",backend="default"} 2097152` + "\n",
+		`postgresql_broker_instance_quota_bytes{instance="a",plan="small",backend="default"} 1048576` + "\n",
+		`postgresql_broker_instance_quota_bytes{instance="b",plan="unlimited",backend="other"} 0` + "\n",
+		`postgresql_broker_instance_quota_exceeded{instance="a",plan="small",backend="default"} 1` + "\n",
+		`postgresql_broker_instance_quota_exceeded{instance="b",plan="unlimited",backend="other"} 0` + "\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("metrics don't contain %q:\n%s", want, buf.String())
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// validateSchema validates the named decoded JSON value against the provided
+// JSON schema returning all violations found, only the subset of the draft-04
+// keywords used by the broker schemas is supported
+func validateSchema(schema map[string]interface{}, value interface{}, path string) []string {
+	if t, ok := schema["type"]; ok && !matchesType(toStrings(t), value) {
+		return []string{fmt.Sprintf("%s: must be %s", path, strings.Join(toStrings(t), " or "))}
+	}
+
+	errs := make([]string, 0)
+	if enum, ok := schema["enum"]; ok {
+		found := false
+		for _, e := range toSlice(enum) {
+			if reflect.DeepEqual(normalize(e), value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("%s: must be one of %v", path, toSlice(enum)))
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		errs = append(errs, validateObject(schema, v, path)...)
+	case []interface{}:
+		if min, ok := toFloat(schema["minItems"]); ok && float64(len(v)) < min {
+			errs = append(errs, fmt.Sprintf("%s: must have at least %v items", path, min))
+		}
+		if max, ok := toFloat(schema["maxItems"]); ok && float64(len(v)) > max {
+			errs = append(errs, fmt.Sprintf("%s: must have at most %v items", path, max))
+		}
+		if unique, _ := schema["uniqueItems"].(bool); unique {
+			for i := range v {
+				for j := 0; j < i; j++ {
+					if reflect.DeepEqual(v[i], v[j]) {
+						errs = append(errs, fmt.Sprintf("%s[%d]: duplicates item %d", path, i, j))
+					}
+				}
+			}
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				errs = append(errs, validateSchema(items, item, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	case string:
+		if min, ok := toFloat(schema["minLength"]); ok && float64(len([]rune(v))) < min {
+			errs = append(errs, fmt.Sprintf("%s: must be at least %v characters long", path, min))
+		}
+		if max, ok := toFloat(schema["maxLength"]); ok && float64(len([]rune(v))) > max {
+			errs = append(errs, fmt.Sprintf("%s: must be at most %v characters long", path, max))
+		}
+		if pattern, ok := schema["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(v) {
+			errs = append(errs, fmt.Sprintf("%s: must match %s", path, pattern))
+		}
+	case float64:
+		if min, ok := toFloat(schema["minimum"]); ok && v < min {
+			errs = append(errs, fmt.Sprintf("%s: must be greater than or equal to %v", path, min))
+		}
+		if max, ok := toFloat(schema["maximum"]); ok && v > max {
+			errs = append(errs, fmt.Sprintf("%s: must be less than or equal to %v", path, max))
+		}
+	}
+	return errs
+}
+
+// validateObject validates properties of the named object
+func validateObject(schema map[string]interface{}, v map[string]interface{}, path string) []string {
+	errs := make([]string, 0)
+	for _, name := range toStrings(schema["required"]) {
+		if _, ok := v[name]; !ok {
+			errs = append(errs, fmt.Sprintf("%s.%s: is required", path, name))
+		}
+	}
+
+	// keys are sorted to report violations in a stable order
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	properties, _ := schema["properties"].(map[string]interface{})
+	for _, k := range keys {
+		if property, ok := properties[k].(map[string]interface{}); ok {
+			errs = append(errs, validateSchema(property, v[k], path+"."+k)...)
+			continue
+		}
+
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				errs = append(errs, fmt.Sprintf("%s.%s: is not allowed", path, k))
+			}
+		case map[string]interface{}:
+			errs = append(errs, validateSchema(additional, v[k], path+"."+k)...)
+		}
+	}
+	return errs
+}
+
+// matchesType checks whether the named value is of one of the named JSON types
+func matchesType(types []string, value interface{}) bool {
+	for _, t := range types {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if t == "object" {
+				return true
+			}
+		case []interface{}:
+			if t == "array" {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case float64:
+			if t == "number" || t == "integer" && v == math.Trunc(v) {
+				return true
+			}
+		case nil:
+			if t == "null" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// toStrings converts a string or a list of strings keyword value
+func toStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []interface{}:
+		s := make([]string, 0, len(v))
+		for _, e := range v {
+			if e, ok := e.(string); ok {
+				s = append(s, e)
+			}
+		}
+		return s
+	}
+	return nil
+}
+
+// toSlice converts a list keyword value
+func toSlice(v interface{}) []interface{} {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice {
+		return nil
+	}
+
+	s := make([]interface{}, rv.Len())
+	for i := range s {
+		s[i] = rv.Index(i).Interface()
+	}
+	return s
+}
+
+// toFloat converts a numeric keyword value
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// normalize converts numbers of schemas built in Go to
+// the type they have once decoded from JSON
+func normalize(v interface{}) interface{} {
+	if f, ok := toFloat(v); ok {
+		return f
+	}
+	return v
+}
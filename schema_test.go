@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/vchrisr/cf-postgresql-broker/pgp"
+)
+
+func TestValidateSchema(t *testing.T) {
+	schema := objectSchema(map[string]interface{}{
+		"name":  map[string]interface{}{"type": "string", "pattern": "^[a-z]+$", "maxLength": 5},
+		"level": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 3},
+		"mode":  map[string]interface{}{"type": "string", "enum": []string{"ro", "rw"}},
+		"tags": map[string]interface{}{
+			"type":        "array",
+			"items":       map[string]interface{}{"type": "string"},
+			"uniqueItems": true,
+		},
+		"settings": map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": map[string]interface{}{"type": "string"},
+		},
+	})
+	schema["required"] = []string{"name"}
+
+	for _, tc := range []struct {
+		doc  string
+		want []string
+	}{
+		{`{"name": "foo", "level": 2, "mode": "ro", "tags": ["a", "b"], "settings": {"a": "b"}}`, nil},
+		{`[]`, []string{"parameters: must be object"}},
+		{`{}`, []string{"parameters.name: is required"}},
+		{`{"name": "foo", "foo": 1}`, []string{"parameters.foo: is not allowed"}},
+		{`{"name": "Foo1"}`, []string{"parameters.name: must match ^[a-z]+$"}},
+		{`{"name": "foobar"}`, []string{"parameters.name: must be at most 5 characters long"}},
+		{`{"name": "foo", "level": 1.5}`, []string{"parameters.level: must be integer"}},
+		{`{"name": "foo", "level": 4}`, []string{"parameters.level: must be less than or equal to 3"}},
+		{`{"name": "foo", "mode": "owner"}`, []string{"parameters.mode: must be one of [ro rw]"}},
+		{`{"name": "foo", "tags": ["a", 1, "a"]}`, []string{"parameters.tags[2]: duplicates item 0", "parameters.tags[1]: must be string"}},
+		{`{"name": "foo", "settings": {"a": 1}}`, []string{"parameters.settings.a: must be string"}},
+	} {
+		var v interface{}
+		if err := json.Unmarshal([]byte(tc.doc), &v); err != nil {
+			t.Fatal(err)
+		}
+
+		errs := validateSchema(schema, v, "parameters")
+		if len(errs) == 0 {
+			errs = nil
+		}
+		if !reflect.DeepEqual(errs, tc.want) {
+			t.Errorf("%s: errs = %q, want %q", tc.doc, errs, tc.want)
+		}
+	}
+}
+
+func TestValidateParams(t *testing.T) {
+	schema := planSchemas(planSettings{}).Instance.Create
+	if err := validateParams(schema, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateParams(schema, json.RawMessage(`{"foo": "bar"}`)); err == nil {
+		t.Fatal("unknown parameter has been accepted")
+	}
+	if err := validateParams(schema, json.RawMessage(`{`)); err == nil {
+		t.Fatal("malformed parameters have been accepted")
+	}
+
+	if err := validateParams(schema, json.RawMessage(`{"encoding": "UTF8", "lc_collate": "de_DE.utf8"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateParams(planSchemas(planSettings{}).Instance.Update, json.RawMessage(`{"encoding": "UTF8"}`)); err == nil {
+		t.Fatal("encoding has been accepted by update")
+	}
+	if err := validateParams(planSchemas(planSettings{Mode: modeSchema, SharedDatabase: defaultSharedDatabase}).Instance.Create, json.RawMessage(`{"encoding": "UTF8"}`)); err == nil {
+		t.Fatal("encoding has been accepted in schema mode")
+	}
+	if err := validateParams(schema, json.RawMessage(`{"clone_from": "1234"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateParams(planSchemas(planSettings{}).Instance.Update, json.RawMessage(`{"clone_from": "1234"}`)); err == nil {
+		t.Fatal("clone_from has been accepted by update")
+	}
+	if err := validateParams(schema, json.RawMessage(`{"clone_from": "1234", "masking": [{"table": "users", "column": "email", "rule": "hash"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	for _, raw := range []string{
+		`{"masking": [{"table": "users", "column": "email", "rule": "shuffle"}]}`,
+		`{"masking": [{"table": "users", "rule": "hash"}]}`,
+	} {
+		if err := validateParams(schema, json.RawMessage(raw)); err == nil {
+			t.Fatalf("%s: has been accepted", raw)
+		}
+	}
+
+	schema = planSchemas(planSettings{Extensions: []string{"pgcrypto", "uuid-ossp"}}).Instance.Update
+	if err := validateParams(schema, json.RawMessage(`{"extensions": ["pgcrypto"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	for _, raw := range []string{`{"extensions": ["postgis"]}`, `{"extensions": ["pgcrypto", "pgcrypto"]}`} {
+		if err := validateParams(schema, json.RawMessage(raw)); err == nil {
+			t.Fatalf("%s: has been accepted", raw)
+		}
+	}
+
+	// updates clear extensions and settings plans without them don't offer
+	schema = planSchemas(planSettings{}).Instance.Update
+	if err := validateParams(schema, json.RawMessage(`{"extensions": [], "settings": {}}`)); err != nil {
+		t.Fatal(err)
+	}
+	for _, raw := range []string{`{"extensions": ["pgcrypto"]}`, `{"settings": {"work_mem": 1024}}`} {
+		if err := validateParams(schema, json.RawMessage(raw)); err == nil {
+			t.Fatalf("%s: has been accepted", raw)
+		}
+	}
+
+	max := int64(60000)
+	schema = planSchemas(planSettings{AllowedSettings: map[string]settingRule{
+		"statement_timeout": {Type: "integer", Maximum: &max},
+		"timezone":          {Type: "string", Enum: []string{"UTC", "Europe/Berlin"}},
+	}}).Instance.Create
+	if err := validateParams(schema, json.RawMessage(`{"settings": {"statement_timeout": 30000, "timezone": "UTC"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	for _, raw := range []string{
+		`{"settings": {"statement_timeout": 90000}}`,
+		`{"settings": {"timezone": "Mars"}}`,
+		`{"settings": {"work_mem": 1024}}`,
+	} {
+		if err := validateParams(schema, json.RawMessage(raw)); err == nil {
+			t.Fatalf("%s: has been accepted", raw)
+		}
+	}
+
+	schema = planSchemas(planSettings{}).Binding.Create
+	if err := validateParams(schema, json.RawMessage(`{"role": "readonly"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateParams(schema, json.RawMessage(`{"role": "admin"}`)); err == nil {
+		t.Fatal("unknown role has been accepted")
+	}
+
+	limit := 10
+	schema = planSchemas(planSettings{ConnectionLimit: &limit}).Binding.Create
+	if err := validateParams(schema, json.RawMessage(`{"connection_limit": 5}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateParams(schema, json.RawMessage(`{"connection_limit": 20}`)); err == nil {
+		t.Fatal("connection limit above the plan one has been accepted")
+	}
+}
+
+func TestStatusParam(t *testing.T) {
+	limit := 10
+	for _, settings := range []planSettings{
+		{},
+		{Extensions: []string{"pgcrypto"}, Seeds: []string{"reference"}, ConnectionLimit: &limit,
+			AllowedSettings: map[string]settingRule{"work_mem": {Type: "integer"}}},
+		{Mode: modeSchema, SharedDatabase: defaultSharedDatabase},
+	} {
+		schemas := planSchemas(settings).Instance
+		for _, schema := range []brokerapi.Schema{schemas.Create, schemas.Update} {
+			if _, ok := schema.Parameters["properties"].(map[string]interface{})[statusParam]; ok {
+				t.Fatalf("%+v: %s is a parameter", settings, statusParam)
+			}
+		}
+	}
+}
+
+func TestMaskRules(t *testing.T) {
+	length := 3
+	rules := []maskRule{
+		{Table: "users", Column: "email", Rule: pgp.MaskHash},
+		{Schema: "crm", Table: "contacts", Column: "name", Rule: pgp.MaskTruncate, Length: &length},
+	}
+	if errs := validateMaskRules(rules, "masking"); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	converted := maskRules(rules, true)
+	if converted[0].Schema != "public" || converted[1].Schema != "crm" || converted[1].Length != 3 || !converted[0].Optional {
+		t.Fatalf("rules = %+v", converted)
+	}
+
+	rules[0].Length, rules[1].Length = &length, nil
+	if errs := validateMaskRules(rules, "masking"); len(errs) != 2 {
+		t.Fatalf("errs = %v", errs)
+	}
+}
+
+func TestDBOptions(t *testing.T) {
+	settings := planSettings{Encoding: "UTF8", LCCollate: "C", Template: "template1"}
+	opts := settings.dbOptions(&instanceParams{LCCollate: "de_DE.utf8", ICULocale: "de-DE"})
+	if opts.Encoding != "UTF8" || opts.LCCollate != "de_DE.utf8" || opts.ICULocale != "de-DE" || opts.Template != "template1" {
+		t.Fatalf("options = %+v", opts)
+	}
+}
+
+func TestDisallowedExtension(t *testing.T) {
+	installed := []string{"pgcrypto"}
+	for _, tc := range []struct {
+		extensions []string
+		want       bool
+	}{
+		{nil, true},
+		{[]string{}, true},
+		{[]string{"uuid-ossp"}, true},
+		{[]string{"pgcrypto", "uuid-ossp"}, false},
+	} {
+		name, ok := planSettings{Extensions: tc.extensions}.disallowedExtension(installed)
+		if ok != tc.want || ok && name != "pgcrypto" {
+			t.Errorf("%v: disallowed = %q, %v, want %v", tc.extensions, name, ok, tc.want)
+		}
+	}
+
+	// instances without extensions move to any plan
+	if _, ok := (planSettings{}).disallowedExtension(nil); ok {
+		t.Fatal("no extensions are disallowed")
+	}
+}
+
+func TestMergeParams(t *testing.T) {
+	for _, tc := range []struct {
+		current, update, want string
+	}{
+		{``, ``, ``},
+		{`{"settings": {"a": 1}}`, ``, `{"settings": {"a": 1}}`},
+		{``, `{"settings": {"a": 1}}`, `{"settings":{"a":1}}`},
+		{`{"a": 1}`, `{}`, `{"a":1}`},
+		{`{"settings": {"a": 1}, "b": 2}`, `{"settings": {"c": 3}}`, `{"b":2,"settings":{"c":3}}`},
+	} {
+		merged, err := mergeParams(json.RawMessage(tc.current), json.RawMessage(tc.update))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(merged) != tc.want {
+			t.Errorf("mergeParams(%s, %s) = %s, want %s", tc.current, tc.update, merged, tc.want)
+		}
+	}
+}
+
+func TestAdaptParams(t *testing.T) {
+	max := int64(60000)
+	settings := planSettings{
+		Extensions:      []string{"pgcrypto"},
+		AllowedSettings: map[string]settingRule{"statement_timeout": {Type: "integer", Maximum: &max}},
+	}
+	for _, tc := range []struct {
+		raw, want string
+	}{
+		{``, ``},
+		{`{"encoding": "UTF8", "extensions": ["pgcrypto"]}`, `{"encoding":"UTF8","extensions":["pgcrypto"]}`},
+		{`{"settings": {"statement_timeout": 30000, "work_mem": 1024}}`, `{"settings":{"statement_timeout":30000}}`},
+		{`{"settings": {"statement_timeout": 90000}}`, `{"settings":{}}`},
+	} {
+		adapted, err := adaptParams(settings, json.RawMessage(tc.raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(adapted) != tc.want {
+			t.Errorf("adaptParams(%s) = %s, want %s", tc.raw, adapted, tc.want)
+		}
+	}
+
+	if _, err := adaptParams(settings, json.RawMessage(`{"extensions": ["pgcrypto", "postgis"]}`)); err == nil {
+		t.Fatal("extension the plan doesn't allow has been kept")
+	}
+
+	// cube is created along with earthdistance, it's no parameter of the instance
+	settings = planSettings{Extensions: []string{"earthdistance"}}
+	if _, err := adaptParams(settings, json.RawMessage(`{"extensions": ["earthdistance"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := adaptParams(planSettings{}, json.RawMessage(`{"settings": {}}`)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBindingConnections(t *testing.T) {
+	limit := func(n int) *int { return &n }
+	for _, tc := range []struct {
+		settings planSettings
+		param    *int
+		want     int
+	}{
+		{planSettings{}, nil, -1},
+		{planSettings{}, limit(5), 5},
+		{planSettings{ConnectionLimit: limit(20)}, nil, 20},
+		{planSettings{ConnectionLimit: limit(20), BindingConnectionLimit: limit(5)}, nil, 5},
+		{planSettings{ConnectionLimit: limit(-1), BindingConnectionLimit: limit(5)}, limit(3), 3},
+		{planSettings{BindingConnectionLimit: limit(5)}, limit(10), 5},
+	} {
+		if got := tc.settings.bindingConnections(&bindParams{ConnectionLimit: tc.param}); got != tc.want {
+			t.Errorf("%+v: limit = %d, want %d", tc, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+)
+
+// sealer encrypts and decrypts secrets kept in the store with AES-GCM
+type sealer struct {
+	aead cipher.AEAD
+}
+
+// newSealer creates a sealer with a key derived from the named secret
+func newSealer(secret string) (*sealer, error) {
+	if secret == "" {
+		return nil, errors.New("encryption secret is blank")
+	}
+
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead}, nil
+}
+
+// seal encrypts the named plaintext prepending a random nonce to it
+func (s *sealer) seal(plaintext []byte) ([]byte, error) {
+	if plaintext == nil {
+		return nil, nil
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// open decrypts the named ciphertext produced by seal
+func (s *sealer) open(ciphertext []byte) ([]byte, error) {
+	if ciphertext == nil {
+		return nil, nil
+	}
+
+	size := s.aead.NonceSize()
+	if len(ciphertext) < size {
+		return nil, errors.New("ciphertext is too short")
+	}
+	return s.aead.Open(nil, ciphertext[:size], ciphertext[size:], nil)
+}
@@ -0,0 +1,43 @@
+package store
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSealer(t *testing.T) {
+	if _, err := newSealer(""); err == nil {
+		t.Fatal("has not returned error")
+	}
+
+	s, err := newSealer("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext := []byte(`{"password":"foo"}`)
+	ciphertext, err := s.seal(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(ciphertext, []byte("foo")) {
+		t.Fatal("ciphertext contains the plaintext")
+	}
+
+	got, err := s.open(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatalf("open = %q, want %q", got, plaintext)
+	}
+
+	other, err := newSealer("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.open(ciphertext); err == nil {
+		t.Fatal("opened with a wrong secret")
+	}
+}
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"context"
+	"fmt"
+)
+
+// migrationLock is the advisory lock key serializing migrations
+// of concurrently booting broker instances
+const migrationLock = 0x73625f6d
+
+// migrations is the ordered list of broker schema changes, its index
+// plus one is the schema version, never edit released migrations
+var migrations = []string{
+	// 1: instances, bindings and operations
+	`CREATE TABLE broker.instances (
+		id text PRIMARY KEY,
+		service_id text NOT NULL,
+		plan_id text NOT NULL,
+		organization_guid text NOT NULL DEFAULT '',
+		space_guid text NOT NULL DEFAULT '',
+		parameters jsonb,
+		context jsonb,
+		created_at timestamptz NOT NULL DEFAULT now(),
+		updated_at timestamptz NOT NULL DEFAULT now()
+	);
+	CREATE TABLE broker.bindings (
+		id text NOT NULL,
+		instance_id text NOT NULL REFERENCES broker.instances (id) ON DELETE CASCADE,
+		service_id text NOT NULL,
+		plan_id text NOT NULL,
+		app_guid text NOT NULL DEFAULT '',
+		parameters jsonb,
+		context jsonb,
+		created_at timestamptz NOT NULL DEFAULT now(),
+		PRIMARY KEY (instance_id, id)
+	);
+	CREATE TABLE broker.operations (
+		id text PRIMARY KEY,
+		kind text NOT NULL,
+		instance_id text NOT NULL,
+		binding_id text NOT NULL DEFAULT '',
+		state text NOT NULL,
+		description text NOT NULL DEFAULT '',
+		created_at timestamptz NOT NULL DEFAULT now(),
+		updated_at timestamptz NOT NULL DEFAULT now()
+	);
+	CREATE INDEX operations_instance_id_idx ON broker.operations (instance_id);`,
+
+	// 2: encrypted binding credentials
+	`ALTER TABLE broker.bindings ADD COLUMN credentials bytea;`,
+
+	// 3: operations resumable by the job runner
+	`ALTER TABLE broker.operations
+		ADD COLUMN payload jsonb,
+		ADD COLUMN attempts integer NOT NULL DEFAULT 0,
+		ADD COLUMN run_at timestamptz NOT NULL DEFAULT now();
+	CREATE INDEX operations_state_idx ON broker.operations (state);`,
+
+	// 4: schema-per-instance plans
+	`ALTER TABLE broker.instances ADD COLUMN shared_database text NOT NULL DEFAULT '';`,
+
+	// 5: multiple backends, instances created so far are on the default one
+	`ALTER TABLE broker.instances ADD COLUMN backend text NOT NULL DEFAULT 'default';`,
+
+	// 6: size quotas
+	`ALTER TABLE broker.instances
+		ADD COLUMN size bigint NOT NULL DEFAULT 0,
+		ADD COLUMN quota_exceeded boolean NOT NULL DEFAULT false;`,
+
+	// 7: catalog of logical backups
+	`CREATE TABLE broker.backups (
+		id text NOT NULL,
+		instance_id text NOT NULL REFERENCES broker.instances (id) ON DELETE CASCADE,
+		key text NOT NULL,
+		size bigint NOT NULL,
+		checksum text NOT NULL,
+		created_at timestamptz NOT NULL DEFAULT now(),
+		PRIMARY KEY (instance_id, id)
+	);`,
+
+	// 8: backups outlive their instances until they're expired
+	`ALTER TABLE broker.backups
+		DROP CONSTRAINT backups_instance_id_fkey,
+		ADD COLUMN plan_id text NOT NULL DEFAULT '',
+		ADD COLUMN deprovisioned_at timestamptz;
+	UPDATE broker.backups b SET plan_id = i.plan_id FROM broker.instances i WHERE i.id = b.instance_id;`,
+}
+
+// migrate brings the broker schema up to the latest version
+func (s *Store) migrate(ctx context.Context) error {
+	conn, err := s.conn.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLock); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLock)
+
+	if _, err := conn.ExecContext(ctx, `CREATE SCHEMA IF NOT EXISTS broker;
+		CREATE TABLE IF NOT EXISTS broker.schema_migrations (
+			version integer PRIMARY KEY,
+			applied_at timestamptz NOT NULL DEFAULT now()
+		)`); err != nil {
+		return err
+	}
+
+	var version int
+	if err := conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM broker.schema_migrations").Scan(&version); err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, migrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %v", version+1, err)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO broker.schema_migrations (version) VALUES ($1)", version+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,524 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ErrNotFound is returned when the requested record doesn't exist
+var ErrNotFound = errors.New("record not found")
+
+// ErrExists is returned when a record with the same ID is already stored
+var ErrExists = errors.New("record already exists")
+
+// Store is a durable broker state storage kept in a broker-owned schema
+// of the source database
+type Store struct {
+	conn   *sql.DB
+	sealer *sealer
+}
+
+// Instance is a provisioned service instance
+type Instance struct {
+	ID               string
+	ServiceID        string
+	PlanID           string
+	OrganizationGUID string
+	SpaceGUID        string
+	Parameters       json.RawMessage
+	Context          json.RawMessage
+	// Backend is the name of the server the instance is placed on
+	Backend string
+	// SharedDatabase is the database the instance schema is created in,
+	// blank when the instance is a database of its own
+	SharedDatabase string
+	// Size is the size in bytes the quota monitor has last seen
+	Size int64
+	// QuotaExceeded is set while the instance is restricted to reads
+	QuotaExceeded bool
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// instanceColumns are columns read by scanInstances
+const instanceColumns = `id, service_id, plan_id, organization_guid, space_guid,
+	parameters, context, backend, shared_database, size, quota_exceeded, created_at, updated_at`
+
+// Binding is a service binding of an instance
+type Binding struct {
+	ID         string
+	InstanceID string
+	ServiceID  string
+	PlanID     string
+	AppGUID    string
+	Parameters json.RawMessage
+	Context    json.RawMessage
+	// Credentials are encrypted at rest with the store secret
+	Credentials json.RawMessage
+	CreatedAt   time.Time
+}
+
+// Operation is an asynchronous operation performed on an instance or a binding,
+// it's kept along with everything needed to resume it after a broker restart
+type Operation struct {
+	ID          string
+	Kind        string
+	InstanceID  string
+	BindingID   string
+	State       string
+	Description string
+	// Payload holds arguments of the operation
+	Payload json.RawMessage
+	// Attempts is the number of failed attempts so far
+	Attempts int
+	// RunAt is when the operation is attempted next
+	RunAt     time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Backup is a logical backup of an instance kept in the backup store
+type Backup struct {
+	ID         string
+	InstanceID string
+	// PlanID is the plan of the instance when the backup was taken
+	PlanID string
+	// Key locates the backup in the backup store
+	Key string
+	// Size in bytes and hex encoded SHA-256 Checksum of the backup
+	Size      int64
+	Checksum  string
+	CreatedAt time.Time
+	// DeprovisionedAt is when the instance was deprovisioned, zero while it exists
+	DeprovisionedAt time.Time
+}
+
+// backupColumns are columns read by scanBackups
+const backupColumns = `id, instance_id, plan_id, key, size, checksum, created_at, deprovisioned_at`
+
+// operationColumns are columns read by scanOperation
+const operationColumns = `id, kind, instance_id, binding_id, state, description,
+	payload, attempts, run_at, created_at, updated_at`
+
+// New connects to the named database and migrates the broker schema,
+// secret is used to encrypt binding credentials
+func New(source, secret string) (*Store, error) {
+	sealer, err := newSealer(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := sql.Open("postgres", source)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = conn.Ping(); err != nil {
+		return nil, err
+	}
+
+	s := &Store{conn: conn, sealer: sealer}
+	if err := s.migrate(context.Background()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// CreateInstance stores the provided instance
+func (s *Store) CreateInstance(ctx context.Context, i *Instance) error {
+	return s.insert(ctx, `INSERT INTO broker.instances
+		(id, service_id, plan_id, organization_guid, space_guid, parameters, context, backend, shared_database)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		i.ID, i.ServiceID, i.PlanID, i.OrganizationGUID, i.SpaceGUID, jsonb(i.Parameters), jsonb(i.Context),
+		i.Backend, i.SharedDatabase)
+}
+
+// Instance fetches the named instance
+func (s *Store) Instance(ctx context.Context, id string) (*Instance, error) {
+	rows, err := s.conn.QueryContext(ctx, `SELECT `+instanceColumns+`
+		FROM broker.instances WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	instances, err := scanInstances(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return nil, ErrNotFound
+	}
+	return instances[0], nil
+}
+
+// Instances fetches all stored instances
+func (s *Store) Instances(ctx context.Context) ([]*Instance, error) {
+	rows, err := s.conn.QueryContext(ctx, `SELECT `+instanceColumns+`
+		FROM broker.instances ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	return scanInstances(rows)
+}
+
+// InstanceCounts counts instances placed on every backend
+func (s *Store) InstanceCounts(ctx context.Context) (map[string]int, error) {
+	rows, err := s.conn.QueryContext(ctx, "SELECT backend, count(*) FROM broker.instances GROUP BY backend")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var backend string
+		var n int
+		if err := rows.Scan(&backend, &n); err != nil {
+			return nil, err
+		}
+		counts[backend] = n
+	}
+	return counts, rows.Err()
+}
+
+// UpdateInstance updates plan, parameters and context of the provided instance
+func (s *Store) UpdateInstance(ctx context.Context, i *Instance) error {
+	return s.update(ctx, `UPDATE broker.instances
+		SET plan_id = $2, parameters = $3, context = $4, updated_at = now()
+		WHERE id = $1`,
+		i.ID, i.PlanID, jsonb(i.Parameters), jsonb(i.Context))
+}
+
+// UpdateUsage records size and quota state of the named instance
+func (s *Store) UpdateUsage(ctx context.Context, id string, size int64, exceeded bool) error {
+	return s.update(ctx, "UPDATE broker.instances SET size = $2, quota_exceeded = $3 WHERE id = $1", id, size, exceeded)
+}
+
+// DeleteInstance removes the named instance along with its bindings
+func (s *Store) DeleteInstance(ctx context.Context, id string) error {
+	return s.update(ctx, "DELETE FROM broker.instances WHERE id = $1", id)
+}
+
+// CreateBinding stores the provided binding
+func (s *Store) CreateBinding(ctx context.Context, b *Binding) error {
+	creds, err := s.sealer.seal(b.Credentials)
+	if err != nil {
+		return err
+	}
+
+	return s.insert(ctx, `INSERT INTO broker.bindings
+		(id, instance_id, service_id, plan_id, app_guid, parameters, context, credentials)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		b.ID, b.InstanceID, b.ServiceID, b.PlanID, b.AppGUID, jsonb(b.Parameters), jsonb(b.Context), creds)
+}
+
+// UpdateCredentials replaces credentials of the named binding of the named instance
+func (s *Store) UpdateCredentials(ctx context.Context, instanceID, id string, credentials json.RawMessage) error {
+	creds, err := s.sealer.seal(credentials)
+	if err != nil {
+		return err
+	}
+	return s.update(ctx, "UPDATE broker.bindings SET credentials = $3 WHERE instance_id = $1 AND id = $2", instanceID, id, creds)
+}
+
+// Binding fetches the named binding of the named instance
+func (s *Store) Binding(ctx context.Context, instanceID, id string) (*Binding, error) {
+	rows, err := s.conn.QueryContext(ctx, `SELECT
+		id, instance_id, service_id, plan_id, app_guid, parameters, context, credentials, created_at
+		FROM broker.bindings WHERE instance_id = $1 AND id = $2`, instanceID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	bindings, err := s.scanBindings(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(bindings) == 0 {
+		return nil, ErrNotFound
+	}
+	return bindings[0], nil
+}
+
+// Bindings fetches all bindings of the named instance
+func (s *Store) Bindings(ctx context.Context, instanceID string) ([]*Binding, error) {
+	rows, err := s.conn.QueryContext(ctx, `SELECT
+		id, instance_id, service_id, plan_id, app_guid, parameters, context, credentials, created_at
+		FROM broker.bindings WHERE instance_id = $1 ORDER BY created_at`, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	return s.scanBindings(rows)
+}
+
+// DeleteBinding removes the named binding of the named instance
+func (s *Store) DeleteBinding(ctx context.Context, instanceID, id string) error {
+	return s.update(ctx, "DELETE FROM broker.bindings WHERE instance_id = $1 AND id = $2", instanceID, id)
+}
+
+// CreateOperation stores the provided operation
+func (s *Store) CreateOperation(ctx context.Context, o *Operation) error {
+	return s.insert(ctx, `INSERT INTO broker.operations
+		(id, kind, instance_id, binding_id, state, description, payload)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		o.ID, o.Kind, o.InstanceID, o.BindingID, o.State, o.Description, jsonb(o.Payload))
+}
+
+// Operation fetches the named operation
+func (s *Store) Operation(ctx context.Context, id string) (*Operation, error) {
+	return scanOperation(s.conn.QueryRowContext(ctx, `SELECT `+operationColumns+`
+		FROM broker.operations WHERE id = $1`, id))
+}
+
+// LatestOperation fetches the most recent operation performed on the named
+// instance, or on the named binding when bindingID isn't blank
+func (s *Store) LatestOperation(ctx context.Context, instanceID, bindingID string) (*Operation, error) {
+	return scanOperation(s.conn.QueryRowContext(ctx, `SELECT `+operationColumns+`
+		FROM broker.operations WHERE instance_id = $1 AND binding_id = $2
+		ORDER BY created_at DESC LIMIT 1`, instanceID, bindingID))
+}
+
+// Operations fetches all operations in the named state oldest first
+func (s *Store) Operations(ctx context.Context, state string) ([]*Operation, error) {
+	rows, err := s.conn.QueryContext(ctx, `SELECT `+operationColumns+`
+		FROM broker.operations WHERE state = $1 ORDER BY created_at`, state)
+	if err != nil {
+		return nil, err
+	}
+	return scanOperations(rows)
+}
+
+// BindingOperations fetches operations in the named state performed
+// on any binding of the named instance oldest first
+func (s *Store) BindingOperations(ctx context.Context, instanceID, state string) ([]*Operation, error) {
+	rows, err := s.conn.QueryContext(ctx, `SELECT `+operationColumns+`
+		FROM broker.operations WHERE instance_id = $1 AND binding_id <> '' AND state = $2
+		ORDER BY created_at`, instanceID, state)
+	if err != nil {
+		return nil, err
+	}
+	return scanOperations(rows)
+}
+
+// scanOperations scans all operations of the provided rows and closes them
+func scanOperations(rows *sql.Rows) ([]*Operation, error) {
+	defer rows.Close()
+
+	operations := make([]*Operation, 0)
+	for rows.Next() {
+		o, err := scanOperation(rows)
+		if err != nil {
+			return nil, err
+		}
+		operations = append(operations, o)
+	}
+	return operations, rows.Err()
+}
+
+// UpdateOperation updates state and description of the named operation
+func (s *Store) UpdateOperation(ctx context.Context, id, state, description string) error {
+	return s.update(ctx, `UPDATE broker.operations
+		SET state = $2, description = $3, updated_at = now()
+		WHERE id = $1`, id, state, description)
+}
+
+// RetryOperation records a failed attempt of the named operation
+// and schedules the next one at the provided time
+func (s *Store) RetryOperation(ctx context.Context, id string, attempts int, runAt time.Time, description string) error {
+	return s.update(ctx, `UPDATE broker.operations
+		SET attempts = $2, run_at = $3, description = $4, updated_at = now()
+		WHERE id = $1`, id, attempts, runAt, description)
+}
+
+// CreateBackup stores the provided backup along with the plan of its instance,
+// it returns ErrNotFound when the instance is gone
+func (s *Store) CreateBackup(ctx context.Context, b *Backup) error {
+	res, err := s.conn.ExecContext(ctx, `INSERT INTO broker.backups
+		(id, instance_id, plan_id, key, size, checksum)
+		SELECT $1, id, plan_id, $3, $4, $5 FROM broker.instances WHERE id = $2`,
+		b.ID, b.InstanceID, b.Key, b.Size, b.Checksum)
+	if err, ok := err.(*pq.Error); ok && err.Code == "23505" {
+		return ErrExists
+	}
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Backups fetches all backups of the named instance newest first
+func (s *Store) Backups(ctx context.Context, instanceID string) ([]*Backup, error) {
+	return s.scanBackups(ctx, `SELECT `+backupColumns+` FROM broker.backups
+		WHERE instance_id = $1 AND deprovisioned_at IS NULL
+		ORDER BY created_at DESC, id DESC`, instanceID)
+}
+
+// RetainBackups marks backups of the named instance as deprovisioned,
+// they're kept until they expire
+func (s *Store) RetainBackups(ctx context.Context, instanceID string) error {
+	_, err := s.conn.ExecContext(ctx, `UPDATE broker.backups SET deprovisioned_at = now()
+		WHERE instance_id = $1 AND deprovisioned_at IS NULL`, instanceID)
+	return err
+}
+
+// DeprovisionedBackups fetches backups of instances that are gone, backups
+// recorded while their instance was deprovisioned are marked first
+func (s *Store) DeprovisionedBackups(ctx context.Context) ([]*Backup, error) {
+	if _, err := s.conn.ExecContext(ctx, `UPDATE broker.backups b SET deprovisioned_at = now()
+		WHERE deprovisioned_at IS NULL AND NOT EXISTS (SELECT FROM broker.instances i WHERE i.id = b.instance_id)`); err != nil {
+		return nil, err
+	}
+	return s.scanBackups(ctx, `SELECT `+backupColumns+` FROM broker.backups
+		WHERE deprovisioned_at IS NOT NULL ORDER BY deprovisioned_at, instance_id, id`)
+}
+
+// scanBackups reads backups selected with backupColumns by the named query
+func (s *Store) scanBackups(ctx context.Context, query string, args ...interface{}) ([]*Backup, error) {
+	rows, err := s.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	backups := make([]*Backup, 0)
+	for rows.Next() {
+		b := &Backup{}
+		var deprovisionedAt pq.NullTime
+		if err := rows.Scan(&b.ID, &b.InstanceID, &b.PlanID, &b.Key, &b.Size, &b.Checksum, &b.CreatedAt, &deprovisionedAt); err != nil {
+			return nil, err
+		}
+		b.DeprovisionedAt = deprovisionedAt.Time
+		backups = append(backups, b)
+	}
+	return backups, rows.Err()
+}
+
+// DeleteBackup removes the named backup of the named instance
+func (s *Store) DeleteBackup(ctx context.Context, instanceID, id string) error {
+	return s.update(ctx, "DELETE FROM broker.backups WHERE instance_id = $1 AND id = $2", instanceID, id)
+}
+
+// TryLock takes the named session advisory lock unless another broker instance
+// holds it, ok tells whether it's been taken and release gives it back
+func (s *Store) TryLock(ctx context.Context, name string) (release func(), ok bool, err error) {
+	conn, err := s.conn.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock(hashtext($1))", name).Scan(&ok); err != nil || !ok {
+		conn.Close()
+		return nil, false, err
+	}
+	return func() {
+		conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock(hashtext($1))", name)
+		conn.Close()
+	}, true, nil
+}
+
+// insert executes the named INSERT statement translating unique violations to ErrExists
+func (s *Store) insert(ctx context.Context, query string, args ...interface{}) error {
+	_, err := s.conn.ExecContext(ctx, query, args...)
+	if err, ok := err.(*pq.Error); ok && err.Code == "23505" {
+		return ErrExists
+	}
+	return err
+}
+
+// update executes the named statement returning ErrNotFound when no rows are affected
+func (s *Store) update(ctx context.Context, query string, args ...interface{}) error {
+	res, err := s.conn.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// scanOperation reads an operation selected with operationColumns
+func scanOperation(row interface{ Scan(...interface{}) error }) (*Operation, error) {
+	var payload []byte
+	o := &Operation{}
+	err := row.Scan(&o.ID, &o.Kind, &o.InstanceID, &o.BindingID, &o.State, &o.Description,
+		&payload, &o.Attempts, &o.RunAt, &o.CreatedAt, &o.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	o.Payload = payload
+	return o, nil
+}
+
+// scanInstances reads all instances from the named rows and closes them
+func scanInstances(rows *sql.Rows) ([]*Instance, error) {
+	defer rows.Close()
+
+	instances := make([]*Instance, 0)
+	for rows.Next() {
+		var params, context []byte
+		i := &Instance{}
+		if err := rows.Scan(&i.ID, &i.ServiceID, &i.PlanID, &i.OrganizationGUID, &i.SpaceGUID,
+			&params, &context, &i.Backend, &i.SharedDatabase, &i.Size, &i.QuotaExceeded, &i.CreatedAt, &i.UpdatedAt); err != nil {
+			return nil, err
+		}
+		i.Parameters, i.Context = params, context
+		instances = append(instances, i)
+	}
+	return instances, rows.Err()
+}
+
+// scanBindings reads all bindings from the named rows decrypting
+// their credentials and closes them
+func (s *Store) scanBindings(rows *sql.Rows) ([]*Binding, error) {
+	defer rows.Close()
+
+	bindings := make([]*Binding, 0)
+	for rows.Next() {
+		var params, context, creds []byte
+		b := &Binding{}
+		if err := rows.Scan(&b.ID, &b.InstanceID, &b.ServiceID, &b.PlanID, &b.AppGUID,
+			&params, &context, &creds, &b.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		plain, err := s.sealer.open(creds)
+		if err != nil {
+			return nil, fmt.Errorf("binding %q credentials: %v", b.ID, err)
+		}
+		b.Parameters, b.Context, b.Credentials = params, context, plain
+		bindings = append(bindings, b)
+	}
+	return bindings, rows.Err()
+}
+
+// jsonb converts the named raw json to a query argument, the driver
+// would otherwise send byte slices as bytea
+func jsonb(raw json.RawMessage) interface{} {
+	if len(raw) == 0 {
+		return nil
+	}
+	return string(raw)
+}
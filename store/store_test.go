@@ -0,0 +1,284 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+const testInstance = "test_instance"
+const testBinding = "test_binding"
+
+func TestInstances(t *testing.T) {
+	s := newStore(t)
+	ctx := context.Background()
+	defer s.DeleteInstance(ctx, testInstance)
+
+	instance := &Instance{
+		ID:             testInstance,
+		ServiceID:      "service",
+		PlanID:         "plan",
+		Parameters:     json.RawMessage(`{"foo":"bar"}`),
+		Backend:        "other",
+		SharedDatabase: "shared",
+	}
+	if err := s.CreateInstance(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.CreateInstance(ctx, instance); err != ErrExists {
+		t.Fatalf("err = %v, want %v", err, ErrExists)
+	}
+
+	instance.PlanID = "other"
+	if err := s.UpdateInstance(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.Instance(ctx, testInstance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.PlanID != "other" || string(got.Parameters) != `{"foo": "bar"}` || got.Context != nil || got.Backend != "other" || got.SharedDatabase != "shared" {
+		t.Fatalf("unexpected instance %+v", got)
+	}
+
+	if err := s.UpdateUsage(ctx, testInstance, 1024, true); err != nil {
+		t.Fatal(err)
+	}
+	if i, err := s.Instance(ctx, testInstance); err != nil || i.Size != 1024 || !i.QuotaExceeded {
+		t.Fatalf("instance = %+v, err = %v", i, err)
+	}
+
+	counts, err := s.InstanceCounts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["other"] == 0 {
+		t.Fatalf("unexpected counts %v", counts)
+	}
+
+	if err := s.DeleteInstance(ctx, testInstance); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Instance(ctx, testInstance); err != ErrNotFound {
+		t.Fatalf("err = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestBindings(t *testing.T) {
+	s := newStore(t)
+	ctx := context.Background()
+	defer s.DeleteInstance(ctx, testInstance)
+
+	if err := s.CreateInstance(ctx, &Instance{ID: testInstance, ServiceID: "service", PlanID: "plan"}); err != nil {
+		t.Fatal(err)
+	}
+
+	binding := &Binding{
+		ID:          testBinding,
+		InstanceID:  testInstance,
+		ServiceID:   "service",
+		PlanID:      "plan",
+		Credentials: json.RawMessage(`{"password":"foo"}`),
+	}
+	if err := s.CreateBinding(ctx, binding); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.Binding(ctx, testInstance, testBinding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Credentials) != `{"password":"foo"}` {
+		t.Fatalf("credentials = %s", got.Credentials)
+	}
+
+	bindings, err := s.Bindings(ctx, testInstance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bindings) != 1 || bindings[0].ID != testBinding {
+		t.Fatalf("unexpected bindings %+v", bindings)
+	}
+
+	// bindings are removed along with the instance
+	if err := s.DeleteInstance(ctx, testInstance); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Binding(ctx, testInstance, testBinding); err != ErrNotFound {
+		t.Fatalf("err = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestBackups(t *testing.T) {
+	s := newStore(t)
+	ctx := context.Background()
+	defer s.DeleteInstance(ctx, testInstance)
+
+	if err := s.CreateInstance(ctx, &Instance{ID: testInstance, ServiceID: "service", PlanID: "plan"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"20261016T100000Z", "20261016T110000Z"} {
+		b := &Backup{ID: id, InstanceID: testInstance, Key: testInstance + "/" + id + ".dump", Size: 1024, Checksum: "abc"}
+		if err := s.CreateBackup(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backups, err := s.Backups(ctx, testInstance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 || backups[0].ID != "20261016T110000Z" || backups[1].Size != 1024 {
+		t.Fatalf("unexpected backups %+v", backups)
+	}
+
+	if err := s.DeleteBackup(ctx, testInstance, backups[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteBackup(ctx, testInstance, backups[0].ID); err != ErrNotFound {
+		t.Fatalf("err = %v, want %v", err, ErrNotFound)
+	}
+
+	if backups[1].PlanID != "plan" || !backups[1].DeprovisionedAt.IsZero() {
+		t.Fatalf("unexpected backup %+v", backups[1])
+	}
+
+	// backups outlive their instance, those recorded meanwhile as well
+	if err := s.RetainBackups(ctx, testInstance); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteInstance(ctx, testInstance); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateBackup(ctx, &Backup{ID: "x", InstanceID: testInstance, Key: "x", Checksum: "x"}); err != ErrNotFound {
+		t.Fatalf("err = %v, want %v", err, ErrNotFound)
+	}
+	if backups, err = s.Backups(ctx, testInstance); err != nil || len(backups) != 0 {
+		t.Fatalf("backups = %v, err = %v", backups, err)
+	}
+
+	deprovisioned, err := s.DeprovisionedBackups(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found *Backup
+	for _, b := range deprovisioned {
+		if b.InstanceID == testInstance {
+			found = b
+		}
+	}
+	if found == nil || found.ID != "20261016T100000Z" || found.DeprovisionedAt.IsZero() {
+		t.Fatalf("deprovisioned backups = %v", deprovisioned)
+	}
+	if err := s.DeleteBackup(ctx, testInstance, found.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTryLock(t *testing.T) {
+	s := newStore(t)
+	ctx := context.Background()
+
+	release, ok, err := s.TryLock(ctx, "test")
+	if err != nil || !ok {
+		t.Fatalf("ok = %v, err = %v", ok, err)
+	}
+	if _, ok, err := s.TryLock(ctx, "test"); err != nil || ok {
+		t.Fatalf("lock has been taken twice, err = %v", err)
+	}
+
+	release()
+	release, ok, err = s.TryLock(ctx, "test")
+	if err != nil || !ok {
+		t.Fatalf("ok = %v, err = %v", ok, err)
+	}
+	release()
+}
+
+func TestOperations(t *testing.T) {
+	s := newStore(t)
+	ctx := context.Background()
+	defer s.conn.Exec("DELETE FROM broker.operations WHERE instance_id = $1", testInstance)
+
+	op := &Operation{ID: "test:operation", Kind: "test", InstanceID: testInstance, State: "in progress",
+		Payload: json.RawMessage(`{"foo":"bar"}`)}
+	if err := s.CreateOperation(ctx, op); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := s.Operations(ctx, "in progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, o := range pending {
+		if o.ID == op.ID {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("operation in progress has not been listed")
+	}
+
+	// instance operations aren't binding ones
+	bindingOps, err := s.BindingOperations(ctx, testInstance, "in progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bindingOps) != 0 {
+		t.Fatalf("binding operations = %+v, want none", bindingOps)
+	}
+	bindingOp := &Operation{ID: "test:binding-operation", Kind: "test", InstanceID: testInstance, BindingID: "test-binding", State: "in progress"}
+	if err := s.CreateOperation(ctx, bindingOp); err != nil {
+		t.Fatal(err)
+	}
+	if bindingOps, err = s.BindingOperations(ctx, testInstance, "in progress"); err != nil {
+		t.Fatal(err)
+	}
+	if len(bindingOps) != 1 || bindingOps[0].ID != bindingOp.ID {
+		t.Fatalf("binding operations = %+v, want %s", bindingOps, bindingOp.ID)
+	}
+
+	runAt := time.Now().Add(time.Minute).Truncate(time.Second)
+	if err := s.RetryOperation(ctx, op.ID, 1, runAt, "retrying"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.Operation(ctx, op.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Attempts != 1 || !got.RunAt.Equal(runAt) || string(got.Payload) != `{"foo": "bar"}` {
+		t.Fatalf("unexpected operation %+v", got)
+	}
+
+	if err := s.UpdateOperation(ctx, op.ID, "succeeded", "done"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = s.Operation(ctx, op.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.State != "succeeded" || got.Description != "done" {
+		t.Fatalf("unexpected operation %+v", got)
+	}
+}
+
+func newStore(t *testing.T) *Store {
+	source := os.Getenv("PG_SOURCE")
+	if source == "" {
+		t.Fatal("$PG_SOURCE is required")
+	}
+
+	s, err := New(source, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}